@@ -0,0 +1,246 @@
+/*
+ *
+ * Copyright [2014] [Jörn Domnik]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// apiPrefix is the path all endpoints of the current version of the API are served under
+const apiPrefix = "/api/v1"
+
+// apiError is the body of every error response of the API
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// errorCodes maps the errors of the manager to the status and code of the API error
+var errorCodes = map[error]struct {
+	status int
+	code   string
+}{
+	ErrTooManyVms:         {http.StatusConflict, "too_many_vms"},
+	ErrNoMemory:           {http.StatusConflict, "no_memory"},
+	ErrNoCPU:              {http.StatusConflict, "no_cpu"},
+	ErrNoDisk:             {http.StatusConflict, "no_disk"},
+	ErrBoxNotFound:        {http.StatusUnprocessableEntity, "box_not_found"},
+	ErrInstanceNotFound:   {http.StatusNotFound, "instance_not_found"},
+	ErrJobNotFound:        {http.StatusNotFound, "job_not_found"},
+	ErrShuttingDown:       {http.StatusServiceUnavailable, "shutting_down"},
+	ErrJenkinsUnavailable: {http.StatusServiceUnavailable, "jenkins_unavailable"},
+}
+
+// startRequest is the body of POST /instances
+type startRequest struct {
+	Label string `json:"label"`
+}
+
+// boxInfo describes a configured box in GET /boxes
+type boxInfo struct {
+	Name     string   `json:"name"`
+	Labels   []string `json:"labels"`
+	Memory   string   `json:"memory"`
+	CPUs     int      `json:"cpus"`
+	Disk     string   `json:"disk,omitempty"`
+	Mode     string   `json:"mode"`
+	MinReady int      `json:"min_ready"`
+	Running  int      `json:"running"`
+}
+
+// registerAPI adds the handlers of the API to mux
+func (l *Listener) registerAPI(mux *http.ServeMux) {
+	mux.HandleFunc(apiPrefix+"/instances", l.instancesHandler)
+	mux.HandleFunc(apiPrefix+"/instances/", l.instanceHandler)
+	mux.HandleFunc(apiPrefix+"/jobs/", l.jobHandler)
+	mux.HandleFunc(apiPrefix+"/boxes", l.boxesHandler)
+	mux.HandleFunc(apiPrefix+"/capacity", l.capacityHandler)
+}
+
+// instancesHandler lists the running instances, starts new ones and destroys all instances of a label
+func (l *Listener) instancesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, l.Controller.Provisioner.ListVms())
+	case http.MethodPost:
+		var req startRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", "The body has to be a JSON object with a label: "+err.Error())
+			return
+		}
+		if _, err := parseLabelExpr(req.Label); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_label", err.Error())
+			return
+		}
+		log.Printf("[LISTENER]: Queueing the start of a box for label %s.\n", req.Label)
+		// Requests that can't be admitted are refused right away instead of failing the job
+		job, err := l.Controller.EnqueueStart(req.Label)
+		if err != nil {
+			log.Printf("[LISTENER]: Couldn't queue the start of the requested VM. ERROR: %s\n", err)
+			writeControllerError(w, err)
+			return
+		}
+		writeJob(w, http.StatusAccepted, job)
+	case http.MethodDelete:
+		label := r.URL.Query().Get("label")
+		if _, err := parseLabelExpr(label); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_label", err.Error())
+			return
+		}
+		log.Printf("[LISTENER]: Queueing the destruction of all boxes for label %s.\n", label)
+		job, err := l.Controller.EnqueueDestroy(label, "")
+		if err != nil {
+			log.Printf("[LISTENER]: Couldn't queue the destruction of the boxes. ERROR: %s\n", err)
+			writeControllerError(w, err)
+			return
+		}
+		writeJob(w, http.StatusAccepted, job)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost, http.MethodDelete)
+	}
+}
+
+// instanceHandler returns and destroys single instances at /instances/{id}
+func (l *Listener) instanceHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, apiPrefix+"/instances/")
+	inst, err := l.Controller.Instance(id)
+	if err != nil {
+		writeControllerError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, inst)
+	case http.MethodDelete:
+		log.Printf("[LISTENER]: Queueing the destruction of instance %s.\n", id)
+		job, err := l.Controller.EnqueueDestroy("", id)
+		if err != nil {
+			log.Printf("[LISTENER]: Couldn't queue the destruction of the requested VM. ERROR: %s\n", err)
+			writeControllerError(w, err)
+			return
+		}
+		writeJob(w, http.StatusAccepted, job)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	}
+}
+
+// jobHandler returns the state of a job at /jobs/{id} and its vagrant output at /jobs/{id}/output
+func (l *Listener) jobHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, apiPrefix+"/jobs/")
+	output := strings.HasSuffix(id, "/output")
+	job, err := l.Controller.Jobs.Get(strings.TrimSuffix(id, "/output"))
+	if err != nil {
+		writeControllerError(w, err)
+		return
+	}
+	if output {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, job.Output)
+		return
+	}
+	writeJob(w, http.StatusOK, job)
+}
+
+// boxesHandler lists the configured boxes with the number of their running instances
+func (l *Listener) boxesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	running := make(map[string]int)
+	for _, inst := range l.Controller.Provisioner.ListVms() {
+		running[inst.Box]++
+	}
+	conf := l.Controller.Config.Get()
+	boxes := make([]boxInfo, 0, len(conf.Boxes))
+	for _, b := range conf.Boxes {
+		boxes = append(boxes, boxInfo{b.Name, b.Labels, b.Memory, b.cpus(), b.Disk, b.mode(), b.MinReady, running[b.Name]})
+	}
+	writeJSON(w, http.StatusOK, boxes)
+}
+
+// capacityHandler returns the limits of the host and how much of them is used
+func (l *Listener) capacityHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	capacity, err := l.Controller.Capacity()
+	if err != nil {
+		log.Printf("[LISTENER]: Couldn't get the capacity of the host. ERROR: %s\n", err)
+		writeControllerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, capacity)
+}
+
+// writeJob writes the job as JSON response with the given status code, accepted jobs point to their state
+func writeJob(w http.ResponseWriter, status int, job Job) {
+	if status == http.StatusAccepted {
+		w.Header().Set("Location", apiPrefix+"/jobs/"+job.ID)
+	}
+	writeJSON(w, status, job)
+}
+
+// writeJSON writes v as JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// writeError writes an API error with the given status code
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	body, _ := json.Marshal(struct {
+		Error apiError `json:"error"`
+	}{apiError{code, message}})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// writeControllerError writes err as API error, errors without a code are internal errors
+func writeControllerError(w http.ResponseWriter, err error) {
+	if c, ok := errorCodes[err]; ok {
+		writeError(w, c.status, c.code, err.Error())
+		return
+	}
+	writeError(w, http.StatusInternalServerError, "internal_error", err.Error())
+}
+
+// methodNotAllowed answers requests with a method the endpoint doesn't support
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Allowed methods are "+strings.Join(allowed, ", "))
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// apiRequest sends a request to the API of the controller and returns the recorded response
+func apiRequest(contr *Controller, method string, path string, body string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	l, _ := NewListener(contr.Config, contr)
+	l.registerAPI(mux)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(method, apiPrefix+path, strings.NewReader(body)))
+	return rec
+}
+
+// errorCode returns the code of the API error in the response
+func errorCode(rec *httptest.ResponseRecorder) string {
+	var body struct {
+		Error apiError `json:"error"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	return body.Error.Code
+}
+
+func TestAPIStartInstance(t *testing.T) {
+	fp := &fakeProvisioner{boxMemory: 1024}
+	contr, mj := mockController(t, fp, 4096)
+	defer mj.Close()
+
+	rec := apiRequest(contr, http.MethodPost, "/instances", `{"label":"windows"}`)
+	if rec.Code != http.StatusAccepted || !strings.HasPrefix(rec.Header().Get("Location"), apiPrefix+"/jobs/") {
+		t.Errorf("Fail: expected the start to be accepted, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	tests := []struct {
+		body   string
+		status int
+		code   string
+	}{
+		{`{"label":"linux"}`, http.StatusUnprocessableEntity, "box_not_found"},
+		{`{"label":"windows &&"}`, http.StatusBadRequest, "invalid_label"},
+		{`label=windows`, http.StatusBadRequest, "invalid_request"},
+	}
+	for _, test := range tests {
+		rec := apiRequest(contr, http.MethodPost, "/instances", test.body)
+		if rec.Code != test.status || errorCode(rec) != test.code {
+			t.Errorf("Fail: expected %d %s for %s, got %d %s", test.status, test.code, test.body, rec.Code, rec.Body.String())
+		}
+	}
+
+	fp.mu.Lock()
+	fp.running = 2
+	fp.mu.Unlock()
+	rec = apiRequest(contr, http.MethodPost, "/instances", `{"label":"windows"}`)
+	if rec.Code != http.StatusConflict || errorCode(rec) != "too_many_vms" {
+		t.Errorf("Fail: expected too_many_vms, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAPIInstances(t *testing.T) {
+	fp := &fakeProvisioner{boxMemory: 1024}
+	contr, mj := mockController(t, fp, 4096)
+	defer mj.Close()
+	inst, _ := fp.SpinUpNew("windows", contr.Config.Get().WorkingDirPath, nil, nil)
+
+	var instances []Instance
+	rec := apiRequest(contr, http.MethodGet, "/instances", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &instances); err != nil || len(instances) != 1 {
+		t.Errorf("Fail: expected one instance, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := apiRequest(contr, http.MethodGet, "/instances/"+inst.ID, ""); rec.Code != http.StatusOK {
+		t.Errorf("Fail: expected instance %s, got %d %s", inst.ID, rec.Code, rec.Body.String())
+	}
+	if rec := apiRequest(contr, http.MethodGet, "/instances/unknown", ""); rec.Code != http.StatusNotFound || errorCode(rec) != "instance_not_found" {
+		t.Errorf("Fail: expected instance_not_found, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := apiRequest(contr, http.MethodDelete, "/instances/"+inst.ID, ""); rec.Code != http.StatusAccepted {
+		t.Errorf("Fail: expected the destruction to be accepted, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := apiRequest(contr, http.MethodDelete, "/instances?label=windows", ""); rec.Code != http.StatusAccepted {
+		t.Errorf("Fail: expected the destruction of the label to be accepted, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := apiRequest(contr, http.MethodDelete, "/instances", ""); rec.Code != http.StatusBadRequest || errorCode(rec) != "invalid_label" {
+		t.Errorf("Fail: expected invalid_label without a label, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := apiRequest(contr, http.MethodPut, "/instances", ""); rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") == "" {
+		t.Errorf("Fail: expected method_not_allowed, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAPIBoxesAndCapacity(t *testing.T) {
+	fp := &fakeProvisioner{boxMemory: 1024}
+	contr, mj := mockController(t, fp, 4096)
+	defer mj.Close()
+	contr.HostResources = &fakeHostResources{memory: 4096, cpus: 4, total: 100, free: 80}
+	fp.SpinUpNew("windows", contr.Config.Get().WorkingDirPath, nil, nil)
+
+	var boxes []boxInfo
+	rec := apiRequest(contr, http.MethodGet, "/boxes", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &boxes); err != nil || len(boxes) != 1 || boxes[0].Running != 1 {
+		t.Errorf("Fail: expected one box with one instance, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	var capacity Capacity
+	rec = apiRequest(contr, http.MethodGet, "/capacity", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &capacity); err != nil || capacity.RunningVms != 1 || capacity.HostCPUs != 4 || capacity.FreeMemory != 4096 {
+		t.Errorf("Fail: expected the capacity of the host, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAPIJobOutput(t *testing.T) {
+	fp := &fakeProvisioner{boxMemory: 1024}
+	contr, mj := mockController(t, fp, 4096)
+	defer mj.Close()
+	job, _ := contr.Jobs.Submit(JobDestroy, "windows", "", func(out io.Writer) error {
+		fmt.Fprint(out, "==> default: Destroying VM and associated drives...\n")
+		return nil
+	})
+	for i := 0; i < 100 && job.State != JobSucceeded; i++ {
+		time.Sleep(10 * time.Millisecond)
+		job, _ = contr.Jobs.Get(job.ID)
+	}
+
+	rec := apiRequest(contr, http.MethodGet, "/jobs/"+job.ID, "")
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "Destroying") {
+		t.Errorf("Fail: expected the job without its output, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = apiRequest(contr, http.MethodGet, "/jobs/"+job.ID+"/output", "")
+	if rec.Code != http.StatusOK || rec.Body.String() != "==> default: Destroying VM and associated drives...\n" {
+		t.Errorf("Fail: expected the output of the job, got %d %q", rec.Code, rec.Body.String())
+	}
+}
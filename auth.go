@@ -0,0 +1,116 @@
+/*
+ *
+ * Copyright [2014] [Jörn Domnik]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Roles of API tokens, every role may do everything the roles before it may do
+const (
+	// RoleReadOnly may read the instances, jobs, boxes and the capacity
+	RoleReadOnly = "read-only"
+	// RoleOperator may start and destroy single boxes
+	RoleOperator = "operator"
+	// RoleAdmin may also destroy all boxes of a label and read the vagrant output of jobs
+	RoleAdmin = "admin"
+)
+
+// roleLevels orders the roles by their permissions
+var roleLevels = map[string]int{RoleReadOnly: 1, RoleOperator: 2, RoleAdmin: 3}
+
+// checkTokens returns a ValidationError if a token has no name or token, or an unknown role
+func checkTokens(tokens []confToken) error {
+	var v validator
+	v.tokens(tokens)
+	return v.err()
+}
+
+// requiredRole returns the role a request needs. Destroying all boxes of a label and reading the vagrant output
+// of a job, which may contain secrets of the boxes, need admin, other reads need read-only and everything else
+// operator.
+func requiredRole(r *http.Request) string {
+	switch {
+	case r.Method == http.MethodDelete && r.URL.Path == apiPrefix+"/instances":
+		return RoleAdmin
+	case strings.HasPrefix(r.URL.Path, apiPrefix+"/jobs/") && strings.HasSuffix(r.URL.Path, "/output"):
+		return RoleAdmin
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return RoleReadOnly
+	}
+	return RoleOperator
+}
+
+// authenticate returns the token the request was sent with, it is nil if the request has no valid token
+func (l *Listener) authenticate(r *http.Request) *confToken {
+	name, secret, basic := r.BasicAuth()
+	if !basic {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return nil
+		}
+		secret = strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	// Every token is compared in constant time, so the time of a request doesn't tell how much of a token matched
+	var found *confToken
+	tokens := l.Config.Get().APITokens
+	for i := range tokens {
+		t := &tokens[i]
+		match := subtle.ConstantTimeCompare([]byte(t.Token), []byte(secret)) == 1
+		if basic {
+			match = match && subtle.ConstantTimeCompare([]byte(t.Name), []byte(name)) == 1
+		}
+		if match && found == nil {
+			found = t
+		}
+	}
+	return found
+}
+
+// authorize checks the token and the role of every request before it is passed to next. Without configured
+// tokens every request is passed.
+func (l *Listener) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(l.Config.Get().APITokens) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := l.authenticate(r)
+		if token == nil {
+			log.Printf("[AUTH]: Rejected %s %s from %s, no valid token.\n", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="jenkins-agent-manager", Basic realm="jenkins-agent-manager"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized", "A valid bearer token or basic auth is required")
+			return
+		}
+		role := requiredRole(r)
+		if roleLevels[token.Role] < roleLevels[role] {
+			log.Printf("[AUTH]: Rejected %s %s from %s, token %s has role %s, %s is required.\n",
+				r.Method, r.URL.Path, r.RemoteAddr, token.Name, token.Role, role)
+			writeError(w, http.StatusForbidden, "forbidden", "The role "+role+" is required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
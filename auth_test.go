@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorizeAdmin(t *testing.T) {
+	conf, _ := mockConfig()
+	conf.APITokens = []confToken{
+		{Name: "ci", Token: "operate", Role: RoleOperator},
+		{Name: "ops", Token: "administrate", Role: RoleAdmin},
+	}
+	l, _ := NewListener(NewConfigHolder(conf), nil)
+	handler := l.authorize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		method, path, token string
+		status              int
+	}{
+		{http.MethodDelete, "/instances?label=windows", "operate", http.StatusForbidden},
+		{http.MethodDelete, "/instances?label=windows", "administrate", http.StatusOK},
+		{http.MethodGet, "/jobs/1/output", "operate", http.StatusForbidden},
+		{http.MethodGet, "/jobs/1/output", "administrate", http.StatusOK},
+		{http.MethodGet, "/jobs/1", "operate", http.StatusOK},
+		{http.MethodDelete, "/instances/1", "operate", http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, apiPrefix+test.path, nil)
+		r.Header.Set("Authorization", "Bearer "+test.token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		if rec.Code != test.status {
+			t.Errorf("Fail: expected %d for %s %s with %s, got %d", test.status, test.method, test.path, test.token, rec.Code)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	conf, _ := mockConfig()
+	conf.APITokens = []confToken{
+		{Name: "dashboard", Token: "read", Role: RoleReadOnly},
+		{Name: "ci", Token: "operate", Role: RoleOperator},
+	}
+	l, err := NewListener(NewConfigHolder(conf), nil)
+	if err != nil {
+		t.Fatalf("Fail: %s", err)
+	}
+	handler := l.authorize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		method string
+		auth   func(r *http.Request)
+		status int
+	}{
+		{http.MethodGet, func(r *http.Request) {}, http.StatusUnauthorized},
+		{http.MethodGet, func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }, http.StatusUnauthorized},
+		{http.MethodGet, func(r *http.Request) { r.Header.Set("Authorization", "Bearer read") }, http.StatusOK},
+		{http.MethodPost, func(r *http.Request) { r.Header.Set("Authorization", "Bearer read") }, http.StatusForbidden},
+		{http.MethodPost, func(r *http.Request) { r.Header.Set("Authorization", "Bearer operate") }, http.StatusOK},
+		{http.MethodDelete, func(r *http.Request) { r.SetBasicAuth("ci", "operate") }, http.StatusOK},
+		{http.MethodDelete, func(r *http.Request) { r.SetBasicAuth("dashboard", "operate") }, http.StatusUnauthorized},
+	}
+	for i, test := range tests {
+		// Destroying a single instance is enough for an operator
+		path := apiPrefix + "/instances"
+		if test.method == http.MethodDelete {
+			path += "/1"
+		}
+		r := httptest.NewRequest(test.method, path, nil)
+		test.auth(r)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		if rec.Code != test.status {
+			t.Errorf("Fail: expected %d for request %d, got %d %s", test.status, i, rec.Code, rec.Body.String())
+		}
+	}
+
+	conf.APITokens = append(conf.APITokens, confToken{Name: "root", Token: "x", Role: "superuser"})
+	if _, err := NewListener(NewConfigHolder(conf), nil); err == nil {
+		t.Errorf("Fail: expected an error for an unknown role")
+	}
+}
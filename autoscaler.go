@@ -0,0 +1,193 @@
+/*
+ *
+ * Copyright [2014] [Jörn Domnik]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Autoscaler starts boxes for the labels builds are waiting for in the Jenkins queue and destroys
+// boxes whose agents have been idle for too long
+type Autoscaler struct {
+	Controller  *Controller
+	Interval    time.Duration
+	IdleTimeout time.Duration
+
+	// idleSince remembers since when the agent of an instance is idle, keyed by instance id
+	idleSince map[string]time.Time
+}
+
+// NewAutoscaler creates an Autoscaler polling Jenkins every interval, an idleTimeout of zero disables scaling down
+func NewAutoscaler(c *Controller, interval time.Duration, idleTimeout time.Duration) (*Autoscaler, error) {
+	return &Autoscaler{c, interval, idleTimeout, make(map[string]time.Time)}, nil
+}
+
+// Run polls Jenkins and scales the boxes until stop is closed
+func (a *Autoscaler) Run(stop <-chan struct{}) {
+	log.Printf("[AUTOSCALER]: Polling Jenkins every %s, idle timeout is %s.\n", a.Interval, a.IdleTimeout)
+	ticker := time.NewTicker(a.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			a.Scale()
+		}
+	}
+}
+
+// Scale runs one scaling round
+func (a *Autoscaler) Scale() {
+	info, err := a.Controller.JenkinsConnector.GetComputerInfo()
+	if err != nil {
+		log.Printf("[AUTOSCALER]: ERROR: Can't get the Jenkins computers. Error: %s\n", err.Error())
+		return
+	}
+	a.scaleUp(info)
+	if a.IdleTimeout > 0 {
+		a.scaleDown(info, time.Now())
+	}
+}
+
+// scaleUp starts a box for every buildable queue item that no booting box will take care of
+func (a *Autoscaler) scaleUp(info *ComputerInfo) {
+	queue, err := a.Controller.JenkinsConnector.GetQueue()
+	if err != nil {
+		log.Printf("[AUTOSCALER]: ERROR: Can't get the Jenkins queue. Error: %s\n", err.Error())
+		return
+	}
+
+	waiting := make(map[string]int)
+	var labels []string
+	for _, item := range queue.Items {
+		label := item.Label()
+		if !item.Buildable || label == "" {
+			continue
+		}
+		if waiting[label] == 0 {
+			labels = append(labels, label)
+		}
+		waiting[label]++
+	}
+
+	// Boxes that are booting, whose agent didn't connect yet or that are idle will pick up waiting items soon
+	var available []*confBox
+	for _, inst := range a.Controller.Provisioner.ListVms() {
+		if !readyForBuilds(info, inst) {
+			continue
+		}
+		if box, ok := a.Controller.Config.Get().box(inst.Box); ok {
+			available = append(available, box)
+		}
+	}
+
+	for _, label := range labels {
+		if _, err := a.Controller.Provisioner.GetBoxMemory(label); err != nil {
+			continue
+		}
+
+		supply := 0
+		for _, box := range available {
+			if match, _ := matchLabels(label, box.Labels); match {
+				supply++
+			}
+		}
+		// The booting boxes are part of the supply already, only the starts without an instance are added
+		needed := waiting[label] - supply - a.Controller.Unrecorded(label)
+		for i := 0; i < needed; i++ {
+			job, err := a.Controller.EnqueueStart(label)
+			if err == ErrTooManyVms {
+				log.Printf("[AUTOSCALER]: %d items are waiting for %s, but no more boxes are allowed to run.\n", needed-i, label)
+				return
+			}
+			if err != nil {
+				log.Printf("[AUTOSCALER]: Can't start a box for %s. Error: %s\n", label, err.Error())
+				break
+			}
+			log.Printf("[AUTOSCALER]: Queued job %s to start a box for %s.\n", job.ID, label)
+		}
+	}
+}
+
+// scaleDown destroys the instances whose agents have been idle for longer than the idle timeout, but keeps
+// min_ready idle instances of every box
+func (a *Autoscaler) scaleDown(info *ComputerInfo, now time.Time) {
+	instances := a.Controller.Provisioner.ListVms()
+	idle := make(map[string]int)
+	for _, inst := range instances {
+		if c, ok := info.computer(inst.NodeName); ok && c.allIdle() {
+			idle[inst.Box]++
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, inst := range instances {
+		seen[inst.ID] = true
+
+		c, ok := info.computer(inst.NodeName)
+		if !ok || !c.allIdle() {
+			delete(a.idleSince, inst.ID)
+			continue
+		}
+
+		since, ok := a.idleSince[inst.ID]
+		if !ok {
+			a.idleSince[inst.ID] = now
+			continue
+		}
+		if now.Sub(since) < a.IdleTimeout || a.Controller.Jobs.Pending(JobDestroy, "", inst.ID) > 0 {
+			continue
+		}
+		if box, ok := a.Controller.Config.Get().box(inst.Box); ok && idle[inst.Box] <= box.MinReady {
+			continue
+		}
+
+		job, err := a.Controller.EnqueueDestroy("", inst.ID)
+		if err != nil {
+			log.Printf("[AUTOSCALER]: ERROR: Can't queue the destruction of instance %s. Error: %s\n", inst.ID, err.Error())
+			continue
+		}
+		delete(a.idleSince, inst.ID)
+		idle[inst.Box]--
+		log.Printf("[AUTOSCALER]: Instance %s is idle since %s, queued job %s to destroy it.\n", inst.ID, since.Format(time.RFC3339), job.ID)
+	}
+
+	// Forget instances that are gone
+	for id := range a.idleSince {
+		if !seen[id] {
+			delete(a.idleSince, id)
+		}
+	}
+}
+
+// readyForBuilds reports whether the instance is booting, its agent didn't connect yet or its agent is online
+// and idle, so it will take a build soon. A temporarily offline node takes no builds, the build watcher takes
+// the busy nodes of snapshot and ephemeral boxes offline until they are reset or destroyed.
+func readyForBuilds(info *ComputerInfo, inst *Instance) bool {
+	c, ok := info.computer(inst.NodeName)
+	if inst.State == InstanceCreating || !ok {
+		return true
+	}
+	if c.TemporarilyOffline {
+		return false
+	}
+	return c.Offline || c.allIdle()
+}
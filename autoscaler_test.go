@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueueItemLabel(t *testing.T) {
+	items := map[string]queueItem{
+		"linux":   {Why: "Waiting for next available executor on ‘linux’"},
+		"windows": {Why: "There are no nodes with the label ‘windows’"},
+		"centos":  {Task: queueTask{AssignedLabel: &queueLabel{"centos"}}},
+		"":        {Why: "Build #12 is already in progress"},
+	}
+	for expected, item := range items {
+		if label := item.Label(); label != expected {
+			t.Errorf("Fail: expected label %q, got %q", expected, label)
+		}
+	}
+}
+
+// waitForStarts waits until the queued start jobs are done
+func waitForStarts(contr *Controller) {
+	for i := 0; i < 100 && contr.Jobs.Pending(JobStart, "", "") > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestScaleUp(t *testing.T) {
+	fp := &fakeProvisioner{boxMemory: 1024}
+	contr, mj := mockController(t, fp, 8192)
+	defer mj.Close()
+	contr.Config.Get().MaxVms = 3
+	// A booting box will take one of the waiting items
+	fp.SpinUpNew("windows", contr.Config.Get().WorkingDirPath, nil, nil)
+
+	windows := `{"buildable":true,"task":{"assignedLabel":{"name":"windows"}}}`
+	mj.mu.Lock()
+	mj.queue = strings.Join([]string{windows, windows, windows, windows, windows,
+		`{"buildable":false,"task":{"assignedLabel":{"name":"windows"}}}`,
+		`{"buildable":true,"task":{"assignedLabel":{"name":"linux"}}}`}, ",")
+	mj.mu.Unlock()
+
+	a, _ := NewAutoscaler(contr, time.Minute, 0)
+	// 5 items are waiting, but only 2 more boxes may run
+	a.Scale()
+	waitForStarts(contr)
+	if started := fp.ListVms(); len(started) != 3 {
+		t.Fatalf("Fail: expected 2 starts up to max_vm_count, got %d boxes", len(started))
+	}
+
+	// The idle and booting boxes are subtracted from the waiting items
+	contr.Config.Get().MaxVms = 10
+	a.Scale()
+	waitForStarts(contr)
+	a.Scale()
+	waitForStarts(contr)
+	if started := fp.ListVms(); len(started) != 5 {
+		t.Errorf("Fail: expected a box for each of the 5 waiting items, got %d boxes", len(started))
+	}
+	for _, label := range fp.started {
+		if label != "windows" {
+			t.Errorf("Fail: expected only boxes for windows, got one for %s", label)
+		}
+	}
+}
+
+func TestScaleUpBooting(t *testing.T) {
+	fp := &fakeProvisioner{boxMemory: 1024, booting: make(chan struct{})}
+	contr, mj := mockController(t, fp, 8192)
+	defer mj.Close()
+	contr.Config.Get().MaxVms = 10
+	defer close(fp.booting)
+
+	windows := `{"buildable":true,"task":{"assignedLabel":{"name":"windows"}}}`
+	mj.mu.Lock()
+	mj.queue = windows
+	mj.mu.Unlock()
+	a, _ := NewAutoscaler(contr, time.Minute, 0)
+	a.Scale()
+	for i := 0; i < 100 && len(fp.ListVms()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The box is booting for the first item, the second one needs another box right away
+	mj.mu.Lock()
+	mj.queue = windows + "," + windows
+	mj.mu.Unlock()
+	a.Scale()
+	if pending := contr.Jobs.Pending(JobStart, "", ""); pending != 2 {
+		t.Errorf("Fail: expected a second start next to the booting box, got %d start jobs", pending)
+	}
+}
+
+func TestScaleDown(t *testing.T) {
+	fp := &fakeProvisioner{}
+	contr, mj := mockController(t, fp, 4096)
+	defer mj.Close()
+	fp.SpinUpNew("windows", contr.Config.Get().WorkingDirPath, nil, nil)
+
+	a, _ := NewAutoscaler(contr, time.Minute, 10*time.Minute)
+	info := &ComputerInfo{Computers: []computer{{DisplayName: "win7-slave-1", Executors: []executor{{Idle: true}}}}}
+
+	now := time.Now()
+	a.scaleDown(info, now)
+	a.scaleDown(info, now.Add(5*time.Minute))
+	if contr.Jobs.Pending(JobDestroy, "", "1") != 0 || len(fp.destroyedIds()) != 0 {
+		t.Errorf("Fail: instance destroyed before the idle timeout")
+	}
+
+	a.scaleDown(info, now.Add(11*time.Minute))
+	for i := 0; i < 100 && len(fp.destroyedIds()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if destroyed := fp.destroyedIds(); len(destroyed) != 1 || destroyed[0] != "1" {
+		t.Errorf("Fail: expected the idle instance to be destroyed, got %v", destroyed)
+	}
+}
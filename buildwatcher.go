@@ -0,0 +1,181 @@
+/*
+ *
+ * Copyright [2014] [Jörn Domnik]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// defaultBuildWatchInterval is how often the builds are checked if build_watch_interval isn't configured
+const defaultBuildWatchInterval = 15 * time.Second
+
+// Reasons the node of a box is offline while the box waits for the end of its builds
+const (
+	resetOfflineMessage  = "jam: Restoring the clean snapshot after the build"
+	retireOfflineMessage = "jam: Destroying the ephemeral agent after the build"
+)
+
+// BuildWatcher watches the builds the agents of boxes in snapshot and ephemeral mode run. As soon as an agent
+// runs a build or has a new one in its build history its node is taken offline, so it doesn't accept another
+// build. Once the build finished,
+// snapshot boxes are reset to their clean snapshot and ephemeral boxes are destroyed. The builds are
+// recorded with the instance.
+type BuildWatcher struct {
+	Controller *Controller
+	Interval   time.Duration
+}
+
+// NewBuildWatcher creates a BuildWatcher that polls Jenkins every interval
+func NewBuildWatcher(c *Controller, interval time.Duration) (*BuildWatcher, error) {
+	if interval == 0 {
+		interval = defaultBuildWatchInterval
+	}
+	return &BuildWatcher{c, interval}, nil
+}
+
+// Run watches the builds until stop is closed
+func (w *BuildWatcher) Run(stop <-chan struct{}) {
+	log.Printf("[WATCHER]: Watching the builds of the agents every %s.\n", w.Interval)
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			w.Watch()
+		}
+	}
+}
+
+// Watch runs one round of checking the builds of the agents
+func (w *BuildWatcher) Watch() {
+	conf := w.Controller.Config.Get()
+	needed := false
+	for _, box := range conf.Boxes {
+		needed = needed || box.mode() != BoxModePersistent
+	}
+	// Jenkins isn't asked as long as all boxes are persistent
+	if !needed {
+		return
+	}
+
+	info, err := w.Controller.JenkinsConnector.GetComputerInfo()
+	if err != nil {
+		log.Printf("[WATCHER]: ERROR: Can't get the Jenkins computers. Error: %s\n", err.Error())
+		return
+	}
+
+	for _, inst := range w.Controller.Provisioner.ListVms() {
+		box, ok := conf.box(inst.Box)
+		if !ok || box.mode() == BoxModePersistent || inst.State != InstanceRunning {
+			continue
+		}
+		c, ok := info.computer(inst.NodeName)
+		if !ok {
+			continue
+		}
+
+		running := c.builds()
+		builds := running
+		// Builds that started and finished between two rounds only show up in the build history of the node,
+		// it's only asked while the node takes builds
+		if !c.TemporarilyOffline {
+			history, err := w.Controller.JenkinsConnector.GetBuildHistory(inst.NodeName)
+			if err != nil {
+				log.Printf("[WATCHER]: ERROR: Can't get the builds of the node %s. Error: %s\n", inst.NodeName, err.Error())
+				continue
+			}
+			builds = append(builds, history...)
+		}
+		started := unrecorded(inst, builds)
+
+		// The offline reason tells the nodes waiting for the end of their builds from the ones an operator
+		// took offline, it also survives restarts of the manager
+		message := resetOfflineMessage
+		if box.mode() == BoxModeEphemeral {
+			message = retireOfflineMessage
+		}
+		waiting := c.TemporarilyOffline && c.OfflineCauseReason == message
+		if !c.TemporarilyOffline && (len(running) > 0 || len(started) > 0) {
+			if err := w.Controller.JenkinsConnector.SetTemporarilyOffline(inst.NodeName, true, message); err != nil {
+				log.Printf("[WATCHER]: ERROR: Can't take the node %s offline. Error: %s\n", inst.NodeName, err.Error())
+				continue
+			}
+			log.Printf("[WATCHER]: Instance %s started %v, took its node offline.\n", inst.ID, started)
+			waiting = true
+		}
+		w.recordBuilds(inst, started)
+		if waiting && len(running) == 0 {
+			w.finish(inst, box)
+		}
+	}
+}
+
+// unrecorded returns the builds that aren't recorded with the instance yet, without duplicates
+func unrecorded(inst *Instance, builds []string) []string {
+	known := make(map[string]bool)
+	for _, b := range inst.Builds {
+		known[b] = true
+	}
+	var started []string
+	for _, b := range builds {
+		if !known[b] {
+			known[b] = true
+			started = append(started, b)
+		}
+	}
+	return started
+}
+
+// recordBuilds adds the builds the instance didn't run before to its record
+func (w *BuildWatcher) recordBuilds(inst *Instance, started []string) {
+	if len(started) == 0 {
+		return
+	}
+
+	if err := w.Controller.Provisioner.RecordBuilds(inst.ID, started); err != nil {
+		log.Printf("[WATCHER]: ERROR: Can't record the builds of instance %s. Error: %s\n", inst.ID, err.Error())
+		return
+	}
+	for _, b := range started {
+		log.Printf("[WATCHER]: Build %s runs on instance %s at %s.\n", b, inst.ID, inst.Dir)
+	}
+}
+
+// finish queues the reset of a snapshot box or the destruction of an ephemeral box whose builds are finished
+func (w *BuildWatcher) finish(inst *Instance, box *confBox) {
+	if w.Controller.Jobs.Pending(JobReset, "", inst.ID) > 0 || w.Controller.Jobs.Pending(JobDestroy, "", inst.ID) > 0 {
+		return
+	}
+
+	var job Job
+	var err error
+	if box.mode() == BoxModeEphemeral {
+		job, err = w.Controller.EnqueueDestroy("", inst.ID)
+	} else {
+		job, err = w.Controller.EnqueueReset(inst.ID)
+	}
+	if err != nil {
+		log.Printf("[WATCHER]: ERROR: Can't queue a job for instance %s. Error: %s\n", inst.ID, err.Error())
+		return
+	}
+	log.Printf("[WATCHER]: The builds on instance %s finished, queued %s job %s.\n", inst.ID, job.Kind, job.ID)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBuildWatcherReset(t *testing.T) {
+	fp := &fakeProvisioner{boxMemory: 1024}
+	contr, mj := mockController(t, fp, 4096)
+	defer mj.Close()
+	contr.Config.Get().Boxes[0].Mode = BoxModeSnapshot
+
+	inst, _ := fp.SpinUpNew("windows", contr.Config.Get().WorkingDirPath, nil, nil)
+	inst.State = InstanceRunning
+	mj.nodes = []string{inst.NodeName}
+	mj.builds[inst.NodeName] = "http://localhost:8080/job/test/1/"
+	w, _ := NewBuildWatcher(contr, 0)
+
+	// A running build takes the node offline
+	w.Watch()
+	if reason := mj.offline[inst.NodeName]; reason != resetOfflineMessage {
+		t.Fatalf("Fail: expected the node to be taken offline, got %q", reason)
+	}
+
+	// A finished build resets the box and brings the node back online
+	mj.mu.Lock()
+	delete(mj.builds, inst.NodeName)
+	mj.mu.Unlock()
+	w.Watch()
+	offline := true
+	for i := 0; i < 100 && offline; i++ {
+		time.Sleep(10 * time.Millisecond)
+		mj.mu.Lock()
+		_, offline = mj.offline[inst.NodeName]
+		mj.mu.Unlock()
+	}
+	if reset := fp.resetIds(); len(reset) != 1 || reset[0] != inst.ID || offline {
+		t.Errorf("Fail: expected instance %s to be reset and online, got %v, offline %t", inst.ID, reset, offline)
+	}
+
+	// Nodes an operator took offline are left alone
+	mj.mu.Lock()
+	mj.offline[inst.NodeName] = "maintenance"
+	mj.mu.Unlock()
+	w.Watch()
+	time.Sleep(50 * time.Millisecond)
+	if reset := fp.resetIds(); len(reset) != 1 {
+		t.Errorf("Fail: expected no reset of a node taken offline by an operator, got %v", reset)
+	}
+}
+
+func TestBuildWatcherEphemeral(t *testing.T) {
+	fp := &fakeProvisioner{boxMemory: 1024}
+	contr, mj := mockController(t, fp, 4096)
+	defer mj.Close()
+	contr.Config.Get().Boxes[0].Mode = BoxModeEphemeral
+	contr.Config.Get().Boxes[0].Executors = 4
+	if executors := contr.Config.Get().Boxes[0].executors(); executors != 1 {
+		t.Errorf("Fail: expected an ephemeral box to have one executor, got %d", executors)
+	}
+
+	inst, _ := fp.SpinUpNew("windows", contr.Config.Get().WorkingDirPath, nil, nil)
+	inst.State = InstanceRunning
+	build := "http://localhost:8080/job/pr/7/"
+	mj.nodes = []string{inst.NodeName}
+	mj.builds[inst.NodeName] = build
+	w, _ := NewBuildWatcher(contr, 0)
+
+	// The build is recorded and the node doesn't accept another one
+	w.Watch()
+	if reason := mj.offline[inst.NodeName]; reason != retireOfflineMessage {
+		t.Fatalf("Fail: expected the node to be taken offline, got %q", reason)
+	}
+	if vms := fp.ListVms(); len(vms[0].Builds) != 1 || vms[0].Builds[0] != build {
+		t.Errorf("Fail: expected the build %s to be recorded, got %v", build, vms[0].Builds)
+	}
+
+	// A finished build destroys the box and deletes its node
+	mj.mu.Lock()
+	delete(mj.builds, inst.NodeName)
+	mj.mu.Unlock()
+	w.Watch()
+	for i := 0; i < 100 && len(fp.destroyedIds()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	mj.mu.Lock()
+	deleted := append([]string(nil), mj.deleted...)
+	mj.mu.Unlock()
+	if destroyed := fp.destroyedIds(); len(destroyed) != 1 || destroyed[0] != inst.ID {
+		t.Errorf("Fail: expected instance %s to be destroyed, got %v", inst.ID, destroyed)
+	}
+	if len(deleted) != 1 || deleted[0] != inst.NodeName {
+		t.Errorf("Fail: expected the node %s to be deleted, got %v", inst.NodeName, deleted)
+	}
+}
+
+func TestBuildWatcherEphemeralShortBuild(t *testing.T) {
+	fp := &fakeProvisioner{boxMemory: 1024}
+	contr, mj := mockController(t, fp, 4096)
+	defer mj.Close()
+	contr.Config.Get().Boxes[0].Mode = BoxModeEphemeral
+
+	inst, _ := fp.SpinUpNew("windows", contr.Config.Get().WorkingDirPath, nil, nil)
+	inst.State = InstanceRunning
+	build := "http://localhost:8080/job/pr/8/"
+	mj.nodes = []string{inst.NodeName}
+	w, _ := NewBuildWatcher(contr, 0)
+	w.Watch()
+
+	// The build started and finished between two rounds, only the build history of the node knows it
+	mj.mu.Lock()
+	mj.history[inst.NodeName] = []string{build}
+	mj.mu.Unlock()
+	w.Watch()
+	for i := 0; i < 100 && len(fp.destroyedIds()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	mj.mu.Lock()
+	reason := mj.offline[inst.NodeName]
+	mj.mu.Unlock()
+	if destroyed := fp.destroyedIds(); len(destroyed) != 1 || destroyed[0] != inst.ID {
+		t.Errorf("Fail: expected instance %s to be destroyed after its build, got %v", inst.ID, destroyed)
+	}
+	if reason != retireOfflineMessage {
+		t.Errorf("Fail: expected the node to be taken offline, got %q", reason)
+	}
+	if vms := fp.ListVms(); len(vms) != 1 || len(vms[0].Builds) != 1 || vms[0].Builds[0] != build {
+		t.Errorf("Fail: expected the build %s to be recorded, got %+v", build, vms)
+	}
+}
+
+func TestBuildWatcherResetShortBuild(t *testing.T) {
+	fp := &fakeProvisioner{boxMemory: 1024}
+	contr, mj := mockController(t, fp, 4096)
+	defer mj.Close()
+	contr.Config.Get().Boxes[0].Mode = BoxModeSnapshot
+
+	inst, _ := fp.SpinUpNew("windows", contr.Config.Get().WorkingDirPath, nil, nil)
+	inst.State = InstanceRunning
+	mj.nodes = []string{inst.NodeName}
+	w, _ := NewBuildWatcher(contr, 0)
+
+	// The build started and finished between two rounds, only the build history of the node knows it
+	mj.mu.Lock()
+	mj.history[inst.NodeName] = []string{"http://localhost:8080/job/test/2/"}
+	mj.mu.Unlock()
+	w.Watch()
+	for i := 0; i < 100 && len(fp.resetIds()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if reset := fp.resetIds(); len(reset) != 1 || reset[0] != inst.ID {
+		t.Fatalf("Fail: expected instance %s to be reset after its build, got %v", inst.ID, reset)
+	}
+
+	// The restored box keeps its build history, the recorded builds don't reset it again
+	mj.mu.Lock()
+	_, offline := mj.offline[inst.NodeName]
+	mj.mu.Unlock()
+	w.Watch()
+	time.Sleep(50 * time.Millisecond)
+	if reset := fp.resetIds(); len(reset) != 1 || offline {
+		t.Errorf("Fail: expected one reset and the node online, got %v, offline %t", reset, offline)
+	}
+}
@@ -2,46 +2,368 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/docker/docker/pkg/units"
+	"gopkg.in/yaml.v2"
 )
 
 type Configuration struct {
-	JenkinsApiUrl    string    `json:"jenkins_api_url"`
-	JenkinsApiSecret string    `json:"jenkins_api_secret"`
-	ListenerPort     string    `json:"listener_port"`
-	MaxVms           int       `json:"max_vm_count"`
-	WorkingDirPath   string    `json:"working_dir_path"`
-	Boxes            []confBox `json:"boxes"`
+	JenkinsApiUrl        string      `json:"jenkins_api_url" yaml:"jenkins_api_url" toml:"jenkins_api_url"`
+	JenkinsApiUser       string      `json:"jenkins_api_user" yaml:"jenkins_api_user" toml:"jenkins_api_user"`
+	JenkinsApiSecret     string      `json:"jenkins_api_secret" yaml:"jenkins_api_secret" toml:"jenkins_api_secret"`
+	JenkinsTimeout       string      `json:"jenkins_timeout" yaml:"jenkins_timeout" toml:"jenkins_timeout"`
+	JenkinsApiSecretFile string      `json:"jenkins_api_secret_file" yaml:"jenkins_api_secret_file" toml:"jenkins_api_secret_file"`
+	ListenerPort         string      `json:"listener_port" yaml:"listener_port" toml:"listener_port"`
+	ListenerAddress      string      `json:"listener_address" yaml:"listener_address" toml:"listener_address"`
+	TLSCertFile          string      `json:"tls_cert_file" yaml:"tls_cert_file" toml:"tls_cert_file"`
+	TLSKeyFile           string      `json:"tls_key_file" yaml:"tls_key_file" toml:"tls_key_file"`
+	TLSClientCAFile      string      `json:"tls_client_ca_file" yaml:"tls_client_ca_file" toml:"tls_client_ca_file"`
+	APITokens            []confToken `json:"api_tokens" yaml:"api_tokens" toml:"api_tokens"`
+	MaxVms               int         `json:"max_vm_count" yaml:"max_vm_count" toml:"max_vm_count"`
+	WorkingDirPath       string      `json:"working_dir_path" yaml:"working_dir_path" toml:"working_dir_path"`
+	JobWorkers           int         `json:"job_workers" yaml:"job_workers" toml:"job_workers"`
+	AutoscaleInterval    string      `json:"autoscale_interval" yaml:"autoscale_interval" toml:"autoscale_interval"`
+	IdleTimeout          string      `json:"idle_timeout" yaml:"idle_timeout" toml:"idle_timeout"`
+	ReconcileInterval    string      `json:"reconcile_interval" yaml:"reconcile_interval" toml:"reconcile_interval"`
+	HostResourceSource   string      `json:"host_resource_source" yaml:"host_resource_source" toml:"host_resource_source"`
+	JenkinsMonitorNode   string      `json:"jenkins_monitor_node" yaml:"jenkins_monitor_node" toml:"jenkins_monitor_node"`
+	CPUOvercommitRatio   float64     `json:"cpu_overcommit_ratio" yaml:"cpu_overcommit_ratio" toml:"cpu_overcommit_ratio"`
+	MaxDiskUsageRatio    float64     `json:"max_disk_usage_ratio" yaml:"max_disk_usage_ratio" toml:"max_disk_usage_ratio"`
+	PoolInterval         string      `json:"pool_interval" yaml:"pool_interval" toml:"pool_interval"`
+	BuildWatchInterval   string      `json:"build_watch_interval" yaml:"build_watch_interval" toml:"build_watch_interval"`
+	ShutdownTimeout      string      `json:"shutdown_timeout" yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	ConfigWatchInterval  string      `json:"config_watch_interval" yaml:"config_watch_interval" toml:"config_watch_interval"`
+	Boxes                []confBox   `json:"boxes" yaml:"boxes" toml:"boxes"`
+}
+
+// ConfigHolder holds the current configuration. A reload replaces the configuration as a whole instead of
+// changing it, so the settings a caller got with Get stay consistent.
+type ConfigHolder struct {
+	current atomic.Pointer[Configuration]
+}
+
+// NewConfigHolder creates a ConfigHolder holding c
+func NewConfigHolder(c *Configuration) *ConfigHolder {
+	h := new(ConfigHolder)
+	h.Set(c)
+	return h
+}
+
+// Get returns the current configuration, it must not be changed
+func (h *ConfigHolder) Get() *Configuration {
+	return h.current.Load()
+}
+
+// Set replaces the current configuration with c
+func (h *ConfigHolder) Set(c *Configuration) {
+	h.current.Store(c)
+}
+
+// confToken grants the role to clients that send the token as bearer token, or name and token with basic auth
+type confToken struct {
+	Name      string `json:"name" yaml:"name" toml:"name"`
+	Token     string `json:"token" yaml:"token" toml:"token"`
+	TokenFile string `json:"token_file" yaml:"token_file" toml:"token_file"`
+	Role      string `json:"role" yaml:"role" toml:"role"`
 }
 
 type confBox struct {
-	Name   string   `json:"name"`
-	Labels []string `json:"labels"`
-	Memory string   `json:"memory"`
+	Name                string   `json:"name" yaml:"name" toml:"name"`
+	Labels              []string `json:"labels" yaml:"labels" toml:"labels"`
+	Memory              string   `json:"memory" yaml:"memory" toml:"memory"`
+	CPUs                int      `json:"cpus" yaml:"cpus" toml:"cpus"`
+	Disk                string   `json:"disk" yaml:"disk" toml:"disk"`
+	RemoteFS            string   `json:"remote_fs" yaml:"remote_fs" toml:"remote_fs"`
+	Executors           int      `json:"executors" yaml:"executors" toml:"executors"`
+	VagrantfileTemplate string   `json:"vagrantfile_template" yaml:"vagrantfile_template" toml:"vagrantfile_template"`
+	MinReady            int      `json:"min_ready" yaml:"min_ready" toml:"min_ready"`
+	Mode                string   `json:"mode" yaml:"mode" toml:"mode"`
+	RetentionStrategy   string   `json:"retention_strategy" yaml:"retention_strategy" toml:"retention_strategy"`
+}
+
+// Modes of a box, they decide what happens to a box after its agent ran a build
+const (
+	// BoxModePersistent boxes keep running builds until they are destroyed
+	BoxModePersistent = "persistent"
+	// BoxModeSnapshot boxes are restored to a clean snapshot after every build
+	BoxModeSnapshot = "snapshot"
+	// BoxModeEphemeral boxes are destroyed after their build, their one-shot retention strategy allows only one
+	BoxModeEphemeral = "ephemeral"
+)
+
+// Defaults for the Jenkins nodes of boxes that don't configure them
+const (
+	defaultRemoteFS          = "/home/vagrant/jenkins"
+	defaultExecutors         = 1
+	defaultRetentionStrategy = "hudson.slaves.RetentionStrategy$Always"
+)
+
+// box returns the configuration of the box with the given name
+func (c *Configuration) box(name string) (*confBox, bool) {
+	for i := range c.Boxes {
+		if c.Boxes[i].Name == name {
+			return &c.Boxes[i], true
+		}
+	}
+	return nil, false
+}
+
+// matchBox returns the box whose labels satisfy the Jenkins label expression. If several boxes match,
+// the first one in the order of the configuration file is used.
+func (c *Configuration) matchBox(expr string) (*confBox, error) {
+	if _, err := parseLabelExpr(expr); err != nil {
+		return nil, err
+	}
+	for i := range c.Boxes {
+		if match, _ := matchLabels(expr, c.Boxes[i].Labels); match {
+			return &c.Boxes[i], nil
+		}
+	}
+	return nil, ErrBoxNotFound
+}
+
+// cpus returns the number of CPUs the box gets, vagrant gives every box one CPU if nothing is configured
+func (b *confBox) cpus() int {
+	if b.CPUs < 1 {
+		return 1
+	}
+	return b.CPUs
+}
+
+// diskBytes returns the disk size of the box in bytes, zero if none is configured
+func (b *confBox) diskBytes() (int64, error) {
+	if b.Disk == "" {
+		return 0, nil
+	}
+	return units.RAMInBytes(b.Disk)
+}
+
+// boxSelector returns a label expression that selects exactly the box with the given name. Earlier boxes
+// that have all labels of the box are excluded with one of their other labels.
+func (c *Configuration) boxSelector(name string) (string, error) {
+	box, ok := c.box(name)
+	if !ok {
+		return "", ErrBoxNotFound
+	}
+
+	terms := make([]string, 0, len(box.Labels))
+	for _, l := range box.Labels {
+		terms = append(terms, strconv.Quote(l))
+	}
+	for i := range c.Boxes {
+		other := &c.Boxes[i]
+		if other == box {
+			break
+		}
+		if match, _ := matchLabels(strings.Join(terms, " && "), other.Labels); !match {
+			continue
+		}
+		excluded := false
+		for _, l := range other.Labels {
+			if match, _ := matchLabels(strconv.Quote(l), box.Labels); !match {
+				terms = append(terms, "!"+strconv.Quote(l))
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			return "", fmt.Errorf("The box %s can't be selected, the box %s has the same labels", name, other.Name)
+		}
+	}
+	if len(terms) == 0 {
+		return "", fmt.Errorf("The box %s has no labels", name)
+	}
+	return strings.Join(terms, " && "), nil
+}
+
+// remoteFS returns the root directory of the Jenkins agent on the box
+func (b *confBox) remoteFS() string {
+	if b.RemoteFS == "" {
+		return defaultRemoteFS
+	}
+	return b.RemoteFS
 }
 
+// retentionStrategy returns the class of the retention strategy the Jenkins node of the box is registered with
+func (b *confBox) retentionStrategy() string {
+	if b.RetentionStrategy == "" {
+		return defaultRetentionStrategy
+	}
+	return b.RetentionStrategy
+}
+
+// mode returns the mode of the box, boxes are persistent if nothing is configured
+func (b *confBox) mode() string {
+	if b.Mode == "" {
+		return BoxModePersistent
+	}
+	return b.Mode
+}
+
+// executors returns the number of executors of the Jenkins agent on the box, ephemeral boxes have only
+// one so they never run builds side by side
+func (b *confBox) executors() int {
+	if b.mode() == BoxModeEphemeral {
+		return 1
+	}
+	if b.Executors < 1 {
+		return defaultExecutors
+	}
+	return b.Executors
+}
+
+// NewConfiguration reads the configuration file at confFile, applies the environment variables and secret files
+// overriding its settings and validates it. If settings are invalid, a ValidationError listing all of them is
+// returned. The warnings of a valid configuration are logged.
 func NewConfiguration(confFile string) (*Configuration, error) {
 	c, err := parseConfFile(confFile)
 	if err != nil {
 		return nil, err
 	}
+	if err := c.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := c.readSecretFiles(); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	for _, w := range c.Warnings() {
+		log.Printf("[CONF]: Warning: %s\n", w.Error())
+	}
 	return c, nil
 }
 
 func parseConfFile(path string) (*Configuration, error) {
 	file, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Fatalf("[CONF]: Error while trying to read configuration file at %s.\nError: %s\n", path, err.Error())
+		log.Printf("[CONF]: Error while trying to read configuration file at %s.\nError: %s\n", path, err.Error())
 		return nil, err
 	}
 
 	var c Configuration
-	err = json.Unmarshal(file, &c)
-	if err != nil {
-		log.Fatalf("[CONF]: Error while parsing the configuration file.\nError: %s\n", err.Error())
+	if err := confDecoder(path)(file, &c); err != nil {
+		// Settings of the wrong type are reported like every other invalid setting
+		if te, ok := typeError(path, file, err); ok {
+			return nil, ValidationError{{settingPath(te.Field), fmt.Sprintf("expected a %s, got a %s", te.Type, te.Value)}}
+		}
+		log.Printf("[CONF]: Error while parsing the configuration file.\nError: %s\n", err.Error())
 		return nil, err
 	}
 
 	return &c, nil
 }
+
+// confDecoder returns the decoder for the format of the configuration file at path. The format is chosen by the
+// extension of the file, files with another extension are JSON like before YAML and TOML were supported.
+func confDecoder(path string) func(data []byte, c *Configuration) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return func(data []byte, c *Configuration) error {
+			return yaml.Unmarshal(data, c)
+		}
+	case ".toml":
+		return func(data []byte, c *Configuration) error {
+			return toml.Unmarshal(data, c)
+		}
+	}
+	return func(data []byte, c *Configuration) error {
+		return json.Unmarshal(data, c)
+	}
+}
+
+// typeError returns the JSON type error for a decoding error that is about a setting of the wrong type. The
+// errors of YAML and TOML don't tell the path of the setting, so the file is decoded into generic values,
+// which are decoded again from JSON to find it.
+func typeError(path string, data []byte, err error) (*json.UnmarshalTypeError, bool) {
+	var generic map[string]interface{}
+	var yamlErr *yaml.TypeError
+	var tomlErr toml.ParseError
+	switch {
+	case errors.As(err, &yamlErr):
+		if yaml.Unmarshal(data, &generic) != nil {
+			return nil, false
+		}
+	case strings.ToLower(filepath.Ext(path)) == ".toml":
+		// Syntax errors are parse errors, type errors are plain errors naming the last key
+		if errors.As(err, &tomlErr) || toml.Unmarshal(data, &generic) != nil {
+			return nil, false
+		}
+	default:
+		te, ok := err.(*json.UnmarshalTypeError)
+		return te, ok
+	}
+
+	js, err := json.Marshal(jsonValue(generic))
+	if err != nil {
+		return nil, false
+	}
+	var c Configuration
+	te, ok := json.Unmarshal(js, &c).(*json.UnmarshalTypeError)
+	return te, ok
+}
+
+// jsonValue converts the maps YAML decodes nested objects into to maps JSON can encode
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonValue(e)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = jsonValue(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = jsonValue(e)
+		}
+		return l
+	case []map[string]interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = jsonValue(e)
+		}
+		return l
+	}
+	return v
+}
+
+// settingPath turns the field of a JSON type error like boxes.1.cpus into the path of the setting, boxes[1].cpus
+func settingPath(field string) string {
+	parts := strings.Split(field, ".")
+	path := parts[0]
+	for _, p := range parts[1:] {
+		if _, err := strconv.Atoi(p); err == nil {
+			path += "[" + p + "]"
+		} else {
+			path += "." + p
+		}
+	}
+	return path
+}
+
+// duration parses a duration setting like "30s" or "10m", an empty setting is zero
+func duration(setting string) (time.Duration, error) {
+	if setting == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(setting)
+}
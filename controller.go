@@ -18,67 +18,499 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"path/filepath"
+	"sync"
+	"time"
 )
 
+// cancelGracePeriod is how long the jobs may take to return once their commands were cancelled on shutdown
+const cancelGracePeriod = time.Minute
+
+// agentEnvFile is written into the vagrant enviroment of an instance, which is shared with the machine,
+// and holds everything the Jenkins agent on the machine needs to connect on its own
+const agentEnvFile = "jenkins-agent.env"
+
 var (
 	ErrTooManyVms = errors.New("Too many vms are running")
 	ErrNoMemory   = errors.New("Not enough system memory available")
+	ErrNoCPU      = errors.New("Not enough CPUs available")
+	ErrNoDisk     = errors.New("Not enough disk space available")
 )
 
 // Controller struct gives other type to hold reference to it
 type Controller struct {
-	VagrantConnector *VagrantConnector
+	Provisioner      Provisioner
 	JenkinsConnector *JenkinsConnector
-	Config           *Configuration
+	HostResources    HostResources
+	Config           *ConfigHolder
+	Jobs             *JobQueue
+
+	// admission makes the admission check and the reservation of a start atomic
+	admission    sync.Mutex
+	reservations map[*reservation]bool
+}
+
+// reservation is the share of the limits of the host a start holds from its admission until its box booted, so
+// concurrent starts can't pass the admission check for the same capacity
+type reservation struct {
+	box    *confBox
+	label  string
+	memory int64
+	// recorded is set once the provisioner recorded the instance, from then on it counts the instance itself
+	recorded bool
 }
 
 // NewController instatiates a new Controller and returns it
-func NewController(vc *VagrantConnector, jc *JenkinsConnector, conf *Configuration) (*Controller, error) {
-	return &Controller{vc, jc, conf}, nil
+func NewController(p Provisioner, jc *JenkinsConnector, conf *ConfigHolder) (*Controller, error) {
+	hr, err := NewHostResources(conf.Get(), jc)
+	if err != nil {
+		return nil, err
+	}
+	return &Controller{
+		Provisioner:      p,
+		JenkinsConnector: jc,
+		HostResources:    hr,
+		Config:           conf,
+		Jobs:             NewJobQueue(conf.Get().JobWorkers),
+		reservations:     make(map[*reservation]bool),
+	}, nil
+}
+
+// Instance returns the running instance with the given id
+func (c *Controller) Instance(id string) (*Instance, error) {
+	for _, inst := range c.Provisioner.ListVms() {
+		if inst.ID == id {
+			return inst, nil
+		}
+	}
+	return nil, ErrInstanceNotFound
+}
+
+// EnqueueStart checks the admission of a start for label and queues a job that starts the box. It returns the
+// job without waiting for the box. The start holds its reservation while it's queued, so the queued starts count
+// against the limits of the host as well.
+func (c *Controller) EnqueueStart(label string) (Job, error) {
+	res, err := c.reserve(label)
+	if err != nil {
+		return Job{}, err
+	}
+	// Queued jobs failed on shutdown keep their reservation, nothing is started afterwards anyway
+	job, err := c.Jobs.Submit(JobStart, label, "", func(out io.Writer) error {
+		return c.start(res, label, out)
+	})
+	if err != nil {
+		c.release(res)
+	}
+	return job, err
+}
+
+// EnqueueDestroy queues a job that destroys the instance with the given id, or all instances for
+// label if id is empty
+func (c *Controller) EnqueueDestroy(label string, id string) (Job, error) {
+	return c.Jobs.Submit(JobDestroy, label, id, func(out io.Writer) error {
+		if id != "" {
+			return c.DestroyInstance(id, out)
+		}
+		return c.DestroyVms(label, out)
+	})
+}
+
+// EnqueueReset queues a job that restores the clean snapshot of the instance with the given id
+func (c *Controller) EnqueueReset(id string) (Job, error) {
+	return c.Jobs.Submit(JobReset, "", id, func(out io.Writer) error {
+		return c.ResetInstance(id, out)
+	})
 }
 
-func (c *Controller) StartVms(label string) error {
+// StartVms checks the admission of a start for label and starts the box
+func (c *Controller) StartVms(label string, out io.Writer) error {
 	log.Printf("[Contr]: Received request to start a box for label %s.\n", label)
-	maxVmCount := c.Config.MaxVms
-	vmCount := c.VagrantConnector.GetVmCount()
+	res, err := c.reserve(label)
+	if err != nil {
+		return err
+	}
+	return c.start(res, label, out)
+}
+
+// start starts a box for label that was admitted with the reservation and releases the reservation afterwards
+func (c *Controller) start(res *reservation, label string, out io.Writer) error {
+	defer c.release(res)
+
+	// The Jenkins node is created before the machine boots, so the agent secret can be put into the Vagrantfile
+	var registered *Instance
+	inst, err := c.Provisioner.SpinUpNew(label, c.Config.Get().WorkingDirPath, func(inst *Instance) (*Agent, error) {
+		// The instance is recorded before it's registered
+		c.record(res)
+		agent, err := c.registerAgent(inst)
+		if err == nil {
+			registered = inst
+		}
+		return agent, err
+	}, out)
+	countOperation("start", err)
+	if err != nil {
+		log.Printf("[Contr]: ERROR: Error while spining up the box for label %s.\n", label)
+		if registered != nil {
+			c.unregisterAgent(registered)
+		}
+		return err
+	}
+	log.Printf("[Contr]: Started instance %s of box %s at %s.\n", inst.ID, inst.Box, inst.Dir)
+
+	return nil
+}
+
+// CheckAdmission checks whether the limits of the host allow to start another box for label
+func (c *Controller) CheckAdmission(label string) error {
+	c.admission.Lock()
+	defer c.admission.Unlock()
+	_, err := c.checkAdmission(label)
+	if err != nil {
+		countRejection(err)
+	}
+	return err
+}
+
+// reserve checks the admission of a start for label and reserves its share of the limits until it's released
+func (c *Controller) reserve(label string) (*reservation, error) {
+	c.admission.Lock()
+	defer c.admission.Unlock()
+	res, err := c.checkAdmission(label)
+	if err != nil {
+		countRejection(err)
+		return nil, err
+	}
+	res.label = label
+	c.reservations[res] = true
+	return res, nil
+}
+
+// Unrecorded returns the number of admitted starts for label, all of them if label is empty, whose instance
+// the provisioner didn't record yet. Once recorded, the booting instance is listed by the provisioner.
+func (c *Controller) Unrecorded(label string) int {
+	c.admission.Lock()
+	defer c.admission.Unlock()
+	count := 0
+	for res := range c.reservations {
+		if !res.recorded && (label == "" || res.label == label) {
+			count++
+		}
+	}
+	return count
+}
+
+// record marks the instance of the reservation as recorded by the provisioner
+func (c *Controller) record(res *reservation) {
+	c.admission.Lock()
+	defer c.admission.Unlock()
+	res.recorded = true
+}
+
+// release frees the reservation once the box booted or failed
+func (c *Controller) release(res *reservation) {
+	c.admission.Lock()
+	defer c.admission.Unlock()
+	delete(c.reservations, res)
+}
+
+// reserved sums up the reservations. The memory and disk of a booting box aren't allocated yet, so they count
+// until the box booted. The VMs and CPUs only count until the provisioner recorded the instance.
+func (c *Controller) reserved() (vms int, memory int64, cpus int, disk int64) {
+	for res := range c.reservations {
+		memory += res.memory
+		if d, err := res.box.diskBytes(); err == nil {
+			disk += d
+		}
+		if !res.recorded {
+			vms++
+			cpus += res.box.cpus()
+		}
+	}
+	return vms, memory, cpus, disk
+}
+
+// checkAdmission checks the limits for a start for label and returns the reservation it needs, the caller
+// holds the admission lock
+func (c *Controller) checkAdmission(label string) (*reservation, error) {
+	// The agent of the box can't be registered while Jenkins is down
+	if err := c.JenkinsConnector.Available(); err != nil {
+		log.Printf("[Contr]: ERROR: %s\n", err.Error())
+		return nil, err
+	}
+	reservedVms, reservedMemory, _, _ := c.reserved()
+
+	maxVmCount := c.Config.Get().MaxVms
+	vmCount := c.Provisioner.GetVmCount() + reservedVms
 
 	log.Printf("[Contr]: %d boxes are running, allowed to run %d boxes", vmCount, maxVmCount)
 	if vmCount+1 > maxVmCount {
 		log.Printf("[Contr]: ERROR: Too many VMs are running")
-		return ErrTooManyVms
+		return nil, ErrTooManyVms
 	}
 
-	freeMemory, err := c.JenkinsConnector.GetFreeSystemMemory()
+	freeMemory, err := c.HostResources.FreeMemory()
 	if err != nil {
 		log.Printf("[Contr]: ERROR: Can't get the free system memory")
-		return err
+		return nil, err
 	}
-	boxMemory, err := c.VagrantConnector.GetBoxMemory(label)
+	boxMemory, err := c.Provisioner.GetBoxMemory(label)
+	if err != nil {
+		log.Printf("[Contr]: ERROR: Can't get required system memory for box with label %s.\n", label)
+		return nil, err
+	}
+
+	// The boxes still booting will take their memory as well
+	if boxMemory+reservedMemory >= freeMemory {
+		log.Printf("[Contr]: ERROR got only %d byte free mem, %d byte needed, %d byte reserved", freeMemory, boxMemory, reservedMemory)
+		return nil, ErrNoMemory
+	}
+
+	box, err := c.Config.Get().matchBox(label)
 	if err != nil {
-		log.Printf("[Contr]: ERROR: Can't get required system memory for box with label %s.\n")
+		return nil, err
+	}
+	if err := c.checkCPUs(box); err != nil {
+		return nil, err
+	}
+	if err := c.checkDisk(box); err != nil {
+		return nil, err
+	}
+	return &reservation{box: box, memory: boxMemory}, nil
+}
+
+// checkCPUs checks that the CPUs of all boxes together don't exceed the CPUs of the host times the
+// configured over-commit ratio
+func (c *Controller) checkCPUs(box *confBox) error {
+	ratio := c.Config.Get().CPUOvercommitRatio
+	if ratio <= 0 {
+		return nil
+	}
+	hostCPUs, err := c.HostResources.CPUs()
+	if err != nil {
+		log.Printf("[Contr]: ERROR: Can't get the number of CPUs of the host")
 		return err
 	}
 
-	//neededMem := boxMemory * int64(count)
-	if boxMemory >= freeMemory {
-		log.Printf("[Contr]: ERROR got only %d byte free mem, %d byte needed", freeMemory, boxMemory)
-		return ErrNoMemory
+	_, _, reservedCPUs, _ := c.reserved()
+	usedCPUs := c.usedCPUs() + reservedCPUs
+	allowed := int(float64(hostCPUs) * ratio)
+	if usedCPUs+box.cpus() > allowed {
+		log.Printf("[Contr]: ERROR: %d CPUs are in use, %d more needed, %d allowed", usedCPUs, box.cpus(), allowed)
+		return ErrNoCPU
 	}
+	return nil
+}
 
-	if err := c.VagrantConnector.SpinUpNew(label, c.Config.WorkingDirPath); err != nil {
-		log.Printf("[Contr]: ERROR: Error while spining up the box for label %s.\n", label)
+// usedCPUs returns the number of CPUs of all running boxes
+func (c *Controller) usedCPUs() int {
+	conf := c.Config.Get()
+	used := 0
+	for _, inst := range c.Provisioner.ListVms() {
+		if b, ok := conf.box(inst.Box); ok {
+			used += b.cpus()
+		}
+	}
+	return used
+}
+
+// Capacity describes the limits of the host and how much of them is used by the boxes
+type Capacity struct {
+	MaxVms       int   `json:"max_vms"`
+	RunningVms   int   `json:"running_vms"`
+	QueuedStarts int   `json:"queued_starts"`
+	FreeMemory   int64 `json:"free_memory"`
+	HostCPUs     int   `json:"host_cpus"`
+	UsedCPUs     int   `json:"used_cpus"`
+	DiskTotal    int64 `json:"disk_total"`
+	DiskFree     int64 `json:"disk_free"`
+}
+
+// Capacity returns the current capacity of the host
+func (c *Controller) Capacity() (*Capacity, error) {
+	conf := c.Config.Get()
+	freeMemory, err := c.HostResources.FreeMemory()
+	if err != nil {
+		return nil, err
+	}
+	hostCPUs, err := c.HostResources.CPUs()
+	if err != nil {
+		return nil, err
+	}
+	total, free, err := c.HostResources.DiskSpace(conf.WorkingDirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Capacity{
+		MaxVms:       conf.MaxVms,
+		RunningVms:   c.Provisioner.GetVmCount(),
+		QueuedStarts: c.Jobs.Pending(JobStart, "", ""),
+		FreeMemory:   freeMemory,
+		HostCPUs:     hostCPUs,
+		UsedCPUs:     c.usedCPUs(),
+		DiskTotal:    total,
+		DiskFree:     free,
+	}, nil
+}
+
+// checkDisk checks that the file system of the working directory isn't used more than the configured ratio
+// once the disk of the box is allocated
+func (c *Controller) checkDisk(box *confBox) error {
+	conf := c.Config.Get()
+	ratio := conf.MaxDiskUsageRatio
+	if ratio <= 0 {
+		return nil
+	}
+	boxDisk, err := box.diskBytes()
+	if err != nil {
+		return err
+	}
+	total, free, err := c.HostResources.DiskSpace(conf.WorkingDirPath)
+	if err != nil {
+		log.Printf("[Contr]: ERROR: Can't get the disk space of %s", conf.WorkingDirPath)
 		return err
 	}
 
+	// The disks of the boxes still booting aren't allocated yet
+	_, _, _, reservedDisk := c.reserved()
+	used := total - free + boxDisk + reservedDisk
+	if float64(used) > float64(total)*ratio {
+		log.Printf("[Contr]: ERROR: got only %d byte free disk space, %d byte needed", free, boxDisk)
+		return ErrNoDisk
+	}
 	return nil
 }
 
-func (c *Controller) DestroyVms(label string) error {
-	if err := c.VagrantConnector.DestroyVms(label, c.Config.WorkingDirPath); err != nil {
+// registerAgent creates a Jenkins node for the instance and hands the agent secret to the machine
+func (c *Controller) registerAgent(inst *Instance) (*Agent, error) {
+	box, ok := c.Config.Get().box(inst.Box)
+	if !ok {
+		return nil, ErrBoxNotFound
+	}
+
+	if err := c.JenkinsConnector.CreateNode(inst.NodeName, box.Labels, box.remoteFS(), box.executors(), box.retentionStrategy()); err != nil {
+		return nil, err
+	}
+	secret, err := c.JenkinsConnector.GetAgentSecret(inst.NodeName)
+	if err != nil {
+		c.unregisterAgent(inst)
+		return nil, err
+	}
+
+	agent := &Agent{JenkinsURL: c.Config.Get().JenkinsApiUrl, Name: inst.NodeName, Secret: secret, WorkDir: box.remoteFS()}
+	env := fmt.Sprintf("JENKINS_URL=%s\nJENKINS_AGENT_NAME=%s\nJENKINS_SECRET=%s\nJENKINS_AGENT_WORKDIR=%s\n",
+		agent.JenkinsURL, agent.Name, agent.Secret, agent.WorkDir)
+	if err := ioutil.WriteFile(filepath.Join(inst.Dir, agentEnvFile), []byte(env), 0600); err != nil {
+		c.unregisterAgent(inst)
+		return nil, err
+	}
+
+	log.Printf("[Contr]: Registered instance %s as Jenkins node %s.\n", inst.ID, inst.NodeName)
+	return agent, nil
+}
+
+// unregisterAgent removes the Jenkins node of the instance
+func (c *Controller) unregisterAgent(inst *Instance) error {
+	if err := c.JenkinsConnector.DeleteNode(inst.NodeName); err != nil {
+		log.Printf("[Contr]: ERROR: Couldn't delete the Jenkins node %s. Error: %s\n", inst.NodeName, err.Error())
+		return err
+	}
+	log.Printf("[Contr]: Deleted the Jenkins node %s.\n", inst.NodeName)
+	return nil
+}
+
+func (c *Controller) DestroyVms(label string, out io.Writer) error {
+	destroyed, err := c.Provisioner.DestroyVms(label, c.Config.Get().WorkingDirPath, out)
+	for range destroyed {
+		countOperation("destroy", nil)
+	}
+	if err != nil {
+		countOperation("destroy", err)
+	}
+	// The nodes of the instances destroyed before a failure have to be removed nevertheless
+	var nodeErr error
+	for _, inst := range destroyed {
+		if uerr := c.unregisterAgent(inst); uerr != nil {
+			nodeErr = uerr
+		}
+	}
+	if err != nil {
 		log.Printf("[Controller]: Error while destroying the boxes for %s\n", label)
 		return err
 	}
+	return nodeErr
+}
+
+func (c *Controller) DestroyInstance(id string, out io.Writer) error {
+	inst, err := c.Provisioner.DestroyInstance(id, out)
+	countOperation("destroy", err)
+	if err != nil {
+		log.Printf("[Controller]: Error while destroying the instance %s\n", id)
+		return err
+	}
+	return c.unregisterAgent(inst)
+}
+
+// ResetInstance restores the clean snapshot of the instance. Its Jenkins node is offline while the machine is
+// restored, an instance that can't be restored is destroyed rather than handing it to the next build.
+func (c *Controller) ResetInstance(id string, out io.Writer) error {
+	inst, err := c.Instance(id)
+	if err != nil {
+		return err
+	}
+
+	if err := c.JenkinsConnector.SetTemporarilyOffline(inst.NodeName, true, resetOfflineMessage); err != nil {
+		log.Printf("[Controller]: Couldn't take the Jenkins node %s offline. Error: %s\n", inst.NodeName, err.Error())
+		return err
+	}
+	if _, err := c.Provisioner.ResetInstance(id, out); err != nil {
+		log.Printf("[Controller]: Error while resetting the instance %s, destroying it\n", id)
+		if derr := c.DestroyInstance(id, out); derr != nil {
+			log.Printf("[Controller]: Error while destroying the instance %s. Error: %s\n", id, derr.Error())
+		}
+		return err
+	}
+	if err := c.JenkinsConnector.SetTemporarilyOffline(inst.NodeName, false, ""); err != nil {
+		log.Printf("[Controller]: Couldn't bring the Jenkins node %s back online. Error: %s\n", inst.NodeName, err.Error())
+		return err
+	}
+	log.Printf("[Controller]: Restored the clean snapshot of instance %s.\n", id)
 	return nil
 }
+
+// Shutdown stops taking jobs and waits for the running ones until ctx is done. Afterwards the commands of
+// the jobs still running are cancelled.
+func (c *Controller) Shutdown(ctx context.Context) error {
+	err := c.Jobs.Shutdown(ctx)
+	if err == nil {
+		return nil
+	}
+
+	log.Printf("[Controller]: The running jobs didn't finish in time, cancelling their commands.\n")
+	c.Provisioner.Cancel()
+	wait, cancel := context.WithTimeout(context.Background(), cancelGracePeriod)
+	defer cancel()
+	if werr := c.Jobs.Shutdown(wait); werr != nil {
+		log.Printf("[Controller]: ERROR: The cancelled jobs didn't return. Error: %s\n", werr.Error())
+	}
+	return err
+}
+
+// DestroyAll destroys every running instance and unregisters its Jenkins node
+func (c *Controller) DestroyAll(out io.Writer) error {
+	var lastErr error
+	for _, inst := range c.Provisioner.ListVms() {
+		if err := c.DestroyInstance(inst.ID, out); err != nil {
+			lastErr = err
+			continue
+		}
+		log.Printf("[Controller]: Destroyed instance %s.\n", inst.ID)
+	}
+	return lastErr
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeProvisioner is an in-memory Provisioner used to test the Controller without vagrant
+type fakeProvisioner struct {
+	mu        sync.Mutex
+	running   int
+	boxMemory int64
+	instances []*Instance
+	started   []string
+	destroyed []string
+	reset     []string
+	// booting holds SpinUpNew after the instance was registered until it's closed, if it's set
+	booting chan struct{}
+}
+
+// mockJenkinsServer records the nodes created and deleted through the API
+type mockJenkinsServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	nodes   []string
+	created []string
+	deleted []string
+	// builds holds the URL of the build a node is running, offline the offline reasons of the nodes
+	builds  map[string]string
+	offline map[string]string
+	// history holds the URLs of the finished builds of the nodes
+	history map[string][]string
+	// queue holds the JSON items of the build queue
+	queue string
+	// user and token are the credentials the server requires, it's open if user is empty
+	user  string
+	token string
+}
+
+func (fp *fakeProvisioner) SpinUpNew(label string, workingPath string, register RegisterFunc, out io.Writer) (*Instance, error) {
+	fp.mu.Lock()
+	fp.running++
+	fp.started = append(fp.started, label)
+	id := fmt.Sprintf("%d", fp.running)
+	inst := &Instance{ID: id, Box: "win7-slave", Label: label, Dir: workingPath, NodeName: "win7-slave-" + id}
+	fp.instances = append(fp.instances, inst)
+	fp.mu.Unlock()
+
+	if register != nil {
+		if _, err := register(inst); err != nil {
+			return nil, err
+		}
+	}
+	if fp.booting != nil {
+		<-fp.booting
+	}
+	return inst, nil
+}
+
+func (fp *fakeProvisioner) DestroyInstance(id string, out io.Writer) (*Instance, error) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.running--
+	fp.destroyed = append(fp.destroyed, id)
+	return &Instance{ID: id, Box: "win7-slave", NodeName: "win7-slave-" + id}, nil
+}
+
+func (fp *fakeProvisioner) ResetInstance(id string, out io.Writer) (*Instance, error) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.reset = append(fp.reset, id)
+	return &Instance{ID: id, Box: "win7-slave", NodeName: "win7-slave-" + id}, nil
+}
+
+func (fp *fakeProvisioner) RecordBuilds(id string, urls []string) error {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	for _, inst := range fp.instances {
+		if inst.ID == id {
+			inst.Builds = append(inst.Builds, urls...)
+			return nil
+		}
+	}
+	return ErrInstanceNotFound
+}
+
+func (fp *fakeProvisioner) DestroyVms(label string, workingDir string, out io.Writer) ([]*Instance, error) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.running--
+	fp.destroyed = append(fp.destroyed, label)
+	return []*Instance{{ID: "1", Box: "win7-slave", NodeName: "win7-slave-1"}}, nil
+}
+
+func (fp *fakeProvisioner) ListVms() []*Instance {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return append([]*Instance(nil), fp.instances...)
+}
+
+func (fp *fakeProvisioner) GetVmCount() int {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return fp.running
+}
+
+// destroyedIds returns the ids and labels passed to the destroy methods so far
+func (fp *fakeProvisioner) destroyedIds() []string {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return append([]string(nil), fp.destroyed...)
+}
+
+// resetIds returns the ids passed to ResetInstance so far
+func (fp *fakeProvisioner) resetIds() []string {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return append([]string(nil), fp.reset...)
+}
+
+func (fp *fakeProvisioner) GetBoxMemory(label string) (int64, error) {
+	return fp.boxMemory, nil
+}
+
+func (fp *fakeProvisioner) Cancel() {}
+
+func mockJenkins(freeMemory int64) *mockJenkinsServer {
+	mj := &mockJenkinsServer{builds: make(map[string]string), offline: make(map[string]string), history: make(map[string][]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/computer/api/json", func(w http.ResponseWriter, r *http.Request) {
+		mj.mu.Lock()
+		defer mj.mu.Unlock()
+		fmt.Fprintf(w, `{"busyExecutors":0,"totalExecutors":2,"computer":[{"displayName":"master",
+			"monitorData":{"hudson.node_monitors.SwapSpaceMonitor":{"availablePhysicalMemory":%d}}}`, freeMemory)
+		for _, n := range mj.nodes {
+			fmt.Fprintf(w, `,{"displayName":%q,"description":%q,%s,"executors":[%s]}`, n, nodeDescription, mj.offlineJSON(n), mj.executorJSON(n))
+		}
+		fmt.Fprint(w, `]}`)
+	})
+	mux.HandleFunc("/computer/doCreateItem", func(w http.ResponseWriter, r *http.Request) {
+		mj.mu.Lock()
+		defer mj.mu.Unlock()
+		mj.created = append(mj.created, r.FormValue("name"))
+		mj.nodes = append(mj.nodes, r.FormValue("name"))
+	})
+	mux.HandleFunc("/computer/", func(w http.ResponseWriter, r *http.Request) {
+		mj.mu.Lock()
+		defer mj.mu.Unlock()
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/computer/"), "/")
+		switch parts[1] {
+		case "slave-agent.jnlp":
+			fmt.Fprintf(w, `<jnlp><application-desc><argument>s3cr3t</argument><argument>%s</argument></application-desc></jnlp>`, parts[0])
+		case "api":
+			fmt.Fprintf(w, `{"displayName":%q,%s}`, parts[0], mj.offlineJSON(parts[0]))
+		case "rssAll":
+			fmt.Fprint(w, `<feed xmlns="http://www.w3.org/2005/Atom">`)
+			for _, b := range append(mj.history[parts[0]], mj.builds[parts[0]]) {
+				if b != "" {
+					fmt.Fprintf(w, `<entry><link type="text/html" href=%q rel="alternate"/></entry>`, b)
+				}
+			}
+			fmt.Fprint(w, `</feed>`)
+		case "toggleOffline":
+			if _, ok := mj.offline[parts[0]]; ok {
+				delete(mj.offline, parts[0])
+			} else {
+				mj.offline[parts[0]] = r.FormValue("offlineMessage")
+			}
+		case "doDelete":
+			mj.deleted = append(mj.deleted, parts[0])
+			for i, n := range mj.nodes {
+				if n == parts[0] {
+					mj.nodes = append(mj.nodes[:i], mj.nodes[i+1:]...)
+					break
+				}
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	mux.HandleFunc("/queue/api/json", func(w http.ResponseWriter, r *http.Request) {
+		mj.mu.Lock()
+		defer mj.mu.Unlock()
+		fmt.Fprintf(w, `{"items":[%s]}`, mj.queue)
+	})
+	mux.HandleFunc("/crumbIssuer/api/json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"crumbRequestField":"Jenkins-Crumb","crumb":"c0ffee"}`)
+	})
+	mj.Server = httptest.NewServer(mj.authorize(mux))
+	return mj
+}
+
+// authorize checks the credentials if user and token are set and rejects POSTs without the crumb like Jenkins
+func (mj *mockJenkinsServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, token, _ := r.BasicAuth()
+		if mj.user != "" && (user != mj.user || token != mj.token) {
+			http.Error(w, "Invalid password/token for user", http.StatusUnauthorized)
+			return
+		}
+		if r.Method == http.MethodPost && r.Header.Get("Jenkins-Crumb") != "c0ffee" {
+			http.Error(w, "No valid crumb was included in the request", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// offlineJSON returns the offline fields of the computer JSON of the node
+func (mj *mockJenkinsServer) offlineJSON(node string) string {
+	reason, offline := mj.offline[node]
+	return fmt.Sprintf(`"offline":%t,"temporarilyOffline":%t,"offlineCauseReason":%q`, offline, offline, reason)
+}
+
+// executorJSON returns the executor JSON of the node
+func (mj *mockJenkinsServer) executorJSON(node string) string {
+	if build, ok := mj.builds[node]; ok {
+		return fmt.Sprintf(`{"idle":false,"currentExecutable":{"url":%q}}`, build)
+	}
+	return `{"idle":true}`
+}
+
+func mockController(t *testing.T, fp *fakeProvisioner, freeMemory int64) (*Controller, *mockJenkinsServer) {
+	conf, err := mockConfig()
+	if err != nil {
+		t.Fatalf("Fail: %s", err)
+	}
+	mj := mockJenkins(freeMemory)
+	conf.JenkinsApiUrl = mj.URL
+	conf.WorkingDirPath = t.TempDir()
+	jc, _ := NewJenkinsConnector(conf.JenkinsApiUrl, conf.JenkinsApiUser, conf.JenkinsApiSecret)
+	contr, _ := NewController(fp, jc, NewConfigHolder(conf))
+	return contr, mj
+}
+
+func TestStartVms(t *testing.T) {
+	fp := &fakeProvisioner{boxMemory: 1024}
+	contr, mj := mockController(t, fp, 4096)
+	defer mj.Close()
+
+	if err := contr.StartVms("windows", ioutil.Discard); err != nil {
+		t.Errorf("Fail: %s", err)
+	}
+	if len(fp.started) != 1 || fp.started[0] != "windows" {
+		t.Errorf("Fail: expected one started box, got %v", fp.started)
+	}
+	if len(mj.created) != 1 || mj.created[0] != "win7-slave-1" {
+		t.Errorf("Fail: expected the node win7-slave-1 to be created, got %v", mj.created)
+	}
+	env, err := ioutil.ReadFile(filepath.Join(contr.Config.Get().WorkingDirPath, agentEnvFile))
+	if err != nil || !strings.Contains(string(env), "JENKINS_SECRET=s3cr3t") {
+		t.Errorf("Fail: expected the agent secret to be handed to the box, got %q, %v", env, err)
+	}
+}
+
+func TestDestroyInstance(t *testing.T) {
+	fp := &fakeProvisioner{running: 1}
+	contr, mj := mockController(t, fp, 4096)
+	defer mj.Close()
+
+	if err := contr.DestroyInstance("1", ioutil.Discard); err != nil {
+		t.Errorf("Fail: %s", err)
+	}
+	if len(mj.deleted) != 1 || mj.deleted[0] != "win7-slave-1" {
+		t.Errorf("Fail: expected the node win7-slave-1 to be deleted, got %v", mj.deleted)
+	}
+}
+
+func TestStartVmsTooMany(t *testing.T) {
+	fp := &fakeProvisioner{running: 2, boxMemory: 1024}
+	contr, mj := mockController(t, fp, 4096)
+	defer mj.Close()
+
+	if err := contr.StartVms("windows", ioutil.Discard); err != ErrTooManyVms {
+		t.Errorf("Fail: expected %s, got %v", ErrTooManyVms, err)
+	}
+}
+
+func TestStartVmsConcurrent(t *testing.T) {
+	fp := &fakeProvisioner{running: 1, boxMemory: 1024}
+	contr, mj := mockController(t, fp, 8192)
+	defer mj.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- contr.StartVms("windows", ioutil.Discard)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	started := 0
+	for err := range errs {
+		if err == nil {
+			started++
+		} else if err != ErrTooManyVms {
+			t.Errorf("Fail: expected %s, got %s", ErrTooManyVms, err)
+		}
+	}
+	if started != 1 || fp.GetVmCount() != 2 {
+		t.Errorf("Fail: expected 1 start up to max_vm_count 2, got %d starts and %d VMs", started, fp.GetVmCount())
+	}
+}
+
+func TestStartVmsReservesMemory(t *testing.T) {
+	fp := &fakeProvisioner{boxMemory: 1500, booting: make(chan struct{})}
+	contr, mj := mockController(t, fp, 4096)
+	defer mj.Close()
+	contr.Config.Get().MaxVms = 10
+
+	// Two boxes are booting, their memory isn't allocated yet but reserved
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			done <- contr.StartVms("windows", ioutil.Discard)
+		}()
+		for fp.GetVmCount() != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	third := make(chan error, 1)
+	go func() {
+		third <- contr.StartVms("windows", ioutil.Discard)
+	}()
+	select {
+	case err := <-third:
+		if err != ErrNoMemory {
+			t.Errorf("Fail: expected %s while 3000 of 4096 bytes are reserved, got %v", ErrNoMemory, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Fail: expected %s while 3000 of 4096 bytes are reserved, a third box is booting", ErrNoMemory)
+	}
+
+	close(fp.booting)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Errorf("Fail: %s", err)
+		}
+	}
+}
+
+func TestStartVmsNoMemory(t *testing.T) {
+	fp := &fakeProvisioner{boxMemory: 8192}
+	contr, mj := mockController(t, fp, 4096)
+	defer mj.Close()
+
+	if err := contr.StartVms("windows", ioutil.Discard); err != ErrNoMemory {
+		t.Errorf("Fail: expected %s, got %v", ErrNoMemory, err)
+	}
+}
+
+func TestEnqueueStart(t *testing.T) {
+	fp := &fakeProvisioner{running: 1, boxMemory: 1024}
+	contr, mj := mockController(t, fp, 4096)
+	defer mj.Close()
+
+	job, err := contr.EnqueueStart("windows")
+	if err != nil || job.State != JobQueued {
+		t.Fatalf("Fail: expected a queued job, got %+v, %v", job, err)
+	}
+
+	// The queued start counts against max_vm_count before it runs
+	if _, err := contr.EnqueueStart("windows"); err != ErrTooManyVms {
+		t.Errorf("Fail: expected %s for a start beyond the queued one, got %v", ErrTooManyVms, err)
+	}
+
+	for i := 0; i < 100 && (job.State == JobQueued || job.State == JobRunning); i++ {
+		time.Sleep(10 * time.Millisecond)
+		job, err = contr.Jobs.Get(job.ID)
+	}
+	if err != nil || job.State != JobSucceeded || job.FinishedAt == nil {
+		t.Errorf("Fail: expected the job to succeed, got %+v", job)
+	}
+}
+
+// fakeHostResources reports fixed host resources
+type fakeHostResources struct {
+	memory      int64
+	cpus        int
+	total, free int64
+}
+
+func (hr *fakeHostResources) FreeMemory() (int64, error) { return hr.memory, nil }
+
+func (hr *fakeHostResources) CPUs() (int, error) { return hr.cpus, nil }
+
+func (hr *fakeHostResources) DiskSpace(path string) (int64, int64, error) {
+	return hr.total, hr.free, nil
+}
+
+func TestCheckAdmissionCPUAndDisk(t *testing.T) {
+	fp := &fakeProvisioner{boxMemory: 1024}
+	contr, mj := mockController(t, fp, 4096)
+	defer mj.Close()
+	contr.Config.Get().MaxVms = 10
+	contr.Config.Get().Boxes[0].CPUs = 2
+	contr.Config.Get().Boxes[0].Disk = "40GB"
+	contr.Config.Get().CPUOvercommitRatio = 1.5
+	contr.Config.Get().MaxDiskUsageRatio = 0.9
+	hr := &fakeHostResources{memory: 4096, cpus: 4, total: 100 << 30, free: 80 << 30}
+	contr.HostResources = hr
+
+	if err := contr.CheckAdmission("windows"); err != nil {
+		t.Errorf("Fail: %s", err)
+	}
+
+	// A fourth box with 2 CPUs exceeds 4 CPUs * 1.5
+	for i := 0; i < 3; i++ {
+		fp.SpinUpNew("windows", contr.Config.Get().WorkingDirPath, nil, nil)
+	}
+	if err := contr.CheckAdmission("windows"); err != ErrNoCPU {
+		t.Errorf("Fail: expected %s, got %v", ErrNoCPU, err)
+	}
+
+	contr.Config.Get().CPUOvercommitRatio = 0
+	hr.free = 40 << 30
+	if err := contr.CheckAdmission("windows"); err != ErrNoDisk {
+		t.Errorf("Fail: expected %s, got %v", ErrNoDisk, err)
+	}
+}
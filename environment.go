@@ -0,0 +1,102 @@
+/*
+ *
+ * Copyright [2014] [Jörn Domnik]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// envPrefix is the prefix of the environment variables overriding settings, JAM_MAX_VM_COUNT overrides max_vm_count
+const envPrefix = "JAM_"
+
+// applyEnv overrides the settings of the configuration with the environment variables lookup finds for them.
+// Lists like boxes and api_tokens are given as JSON.
+func (c *Configuration) applyEnv(lookup func(key string) (string, bool)) error {
+	var v validator
+	rv := reflect.ValueOf(c).Elem()
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		env := envPrefix + strings.ToUpper(name)
+		value, ok := lookup(env)
+		if !ok {
+			continue
+		}
+
+		f := rv.Field(i)
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(value)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				v.add(name, "%s has to be a number, got %q", env, value)
+				continue
+			}
+			f.SetInt(int64(n))
+		case reflect.Float64:
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				v.add(name, "%s has to be a number, got %q", env, value)
+				continue
+			}
+			f.SetFloat(n)
+		default:
+			// The value isn't quoted, it may hold tokens
+			if err := json.Unmarshal([]byte(value), f.Addr().Interface()); err != nil {
+				v.add(name, "%s has to be a JSON list. Error: %s", env, err.Error())
+			}
+		}
+	}
+	return v.err()
+}
+
+// readSecretFiles reads the secrets given as path to a file, like jenkins_api_secret_file. This fits systemd
+// credentials and Docker secrets, which are mounted as files.
+func (c *Configuration) readSecretFiles() error {
+	var v validator
+	readSecretFile(&v, "jenkins_api_secret", c.JenkinsApiSecretFile, &c.JenkinsApiSecret)
+	for i := range c.APITokens {
+		t := &c.APITokens[i]
+		readSecretFile(&v, fmt.Sprintf("api_tokens[%d].token", i), t.TokenFile, &t.Token)
+	}
+	return v.err()
+}
+
+// readSecretFile sets secret to the content of the file at path without the trailing newline, if path is set
+func readSecretFile(v *validator, name string, path string, secret *string) {
+	if path == "" {
+		return
+	}
+	if *secret != "" {
+		v.add(name+"_file", "can't be combined with %s", name)
+		return
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		v.add(name+"_file", "can't be read. Error: %s", err.Error())
+		return
+	}
+	*secret = strings.TrimRight(string(content), "\r\n")
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyEnv(t *testing.T) {
+	conf, _ := mockConfig()
+	env := map[string]string{
+		"JAM_JENKINS_API_SECRET":   "s3cret",
+		"JAM_MAX_VM_COUNT":         "5",
+		"JAM_CPU_OVERCOMMIT_RATIO": "1.5",
+		"JAM_API_TOKENS":           `[{"name":"ci","token":"t","role":"operator"}]`,
+	}
+	lookup := func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+	if err := conf.applyEnv(lookup); err != nil {
+		t.Fatalf("Fail: %s", err)
+	}
+	if conf.JenkinsApiSecret != "s3cret" || conf.MaxVms != 5 || conf.CPUOvercommitRatio != 1.5 || len(conf.APITokens) != 1 {
+		t.Errorf("Fail: expected the settings to be overridden, got %+v", conf)
+	}
+	if conf.WorkingDirPath != "/tmp" {
+		t.Errorf("Fail: expected working_dir_path to be kept, got %s", conf.WorkingDirPath)
+	}
+
+	env = map[string]string{"JAM_MAX_VM_COUNT": "many"}
+	if ve, ok := conf.applyEnv(lookup).(ValidationError); !ok || len(ve) != 1 || ve[0].Path != "max_vm_count" {
+		t.Errorf("Fail: expected a problem with max_vm_count, got %v", ve)
+	}
+}
+
+func TestReadSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	writeTestFile(t, secretFile, "s3cret\n")
+
+	conf, _ := mockConfig()
+	conf.JenkinsApiSecretFile = secretFile
+	conf.APITokens = []confToken{{Name: "ci", TokenFile: secretFile, Role: RoleOperator}}
+	if err := conf.readSecretFiles(); err != nil {
+		t.Fatalf("Fail: %s", err)
+	}
+	if conf.JenkinsApiSecret != "s3cret" || conf.APITokens[0].Token != "s3cret" {
+		t.Errorf("Fail: expected the secrets to be read without the newline, got %q and %q", conf.JenkinsApiSecret, conf.APITokens[0].Token)
+	}
+
+	conf, _ = mockConfig()
+	conf.JenkinsApiSecret = "inline"
+	conf.JenkinsApiSecretFile = secretFile
+	conf.APITokens = []confToken{{Name: "ci", TokenFile: filepath.Join(dir, "missing"), Role: RoleOperator}}
+	ve, ok := conf.readSecretFiles().(ValidationError)
+	if !ok || len(ve) != 2 || ve[0].Path != "jenkins_api_secret_file" || ve[1].Path != "api_tokens[0].token_file" {
+		t.Errorf("Fail: expected problems with both secret files, got %v", ve)
+	}
+}
@@ -0,0 +1,226 @@
+/*
+ *
+ * Copyright [2014] [Jörn Domnik]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Sources of the free host memory that can be configured with host_resource_source
+const (
+	HostResourcesJenkins = "jenkins"
+	HostResourcesMeminfo = "meminfo"
+	HostResourcesCgroup  = "cgroup"
+)
+
+// ErrNoMemAvailable indicates that /proc/meminfo has no MemAvailable line, the kernel is older than 3.14
+var ErrNoMemAvailable = errors.New("No MemAvailable entry found in the meminfo file")
+
+// HostResources reports the resources of the host the boxes are started on
+type HostResources interface {
+	// FreeMemory returns the memory in bytes that is available for new boxes
+	FreeMemory() (int64, error)
+	// CPUs returns the number of CPUs of the host
+	CPUs() (int, error)
+	// DiskSpace returns the total and the free bytes of the file system path is on
+	DiskSpace(path string) (int64, int64, error)
+}
+
+// hostSystem reports the CPUs and disk space of the host the manager runs on, it's embedded by all
+// HostResources since only the source of the free memory differs
+type hostSystem struct{}
+
+func (hostSystem) CPUs() (int, error) {
+	return runtime.NumCPU(), nil
+}
+
+func (hostSystem) DiskSpace(path string) (int64, int64, error) {
+	return diskSpace(path)
+}
+
+// NewHostResources creates the HostResources configured with host_resource_source, the Jenkins monitor
+// is used if nothing is configured
+func NewHostResources(conf *Configuration, jc *JenkinsConnector) (HostResources, error) {
+	switch conf.HostResourceSource {
+	case "", HostResourcesJenkins:
+		return &jenkinsResources{jc: jc, node: conf.JenkinsMonitorNode}, nil
+	case HostResourcesMeminfo:
+		return &meminfoResources{path: "/proc/meminfo"}, nil
+	case HostResourcesCgroup:
+		return &cgroupResources{root: "/sys/fs/cgroup", self: "/proc/self/cgroup", host: meminfoResources{path: "/proc/meminfo"}}, nil
+	}
+	return nil, fmt.Errorf("Unknown host resource source %q", conf.HostResourceSource)
+}
+
+// jenkinsResources reads the free memory from the swap space monitor of a Jenkins node. This only works
+// if the node runs on the host the boxes are started on.
+type jenkinsResources struct {
+	hostSystem
+	jc *JenkinsConnector
+	// node is the name of the Jenkins node, the built-in node is used if it's empty
+	node string
+}
+
+func (r *jenkinsResources) FreeMemory() (int64, error) {
+	return r.jc.GetFreeSystemMemory(r.node)
+}
+
+// meminfoResources reads the free memory of the host from the MemAvailable entry of /proc/meminfo
+type meminfoResources struct {
+	hostSystem
+	path string
+}
+
+func (r *meminfoResources) FreeMemory() (int64, error) {
+	file, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return 0, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(file))
+	for scanner.Scan() {
+		// MemAvailable:    8024412 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return kb * 1024, nil
+	}
+	return 0, ErrNoMemAvailable
+}
+
+// cgroupResources reads the free memory from the memory limit and usage of the cgroup the manager runs in,
+// both cgroup v2 and v1 are supported. The cgroup is looked up in /proc/self/cgroup, so a systemd MemoryMax= of
+// the service is seen. The limits of its parent cgroups apply as well, the one with the least memory left wins.
+// If no cgroup has a limit or more memory left than the host, the free memory of the host is returned.
+type cgroupResources struct {
+	hostSystem
+	// root is the mount point of the cgroup file system, self the cgroup file of the manager's process
+	root string
+	self string
+	host meminfoResources
+}
+
+func (r *cgroupResources) FreeMemory() (int64, error) {
+	hostFree, err := r.host.FreeMemory()
+	if err != nil {
+		return 0, err
+	}
+
+	free, limited, err := r.cgroupFree()
+	if err != nil {
+		return 0, err
+	}
+	if !limited || free > hostFree {
+		return hostFree, nil
+	}
+	if free < 0 {
+		free = 0
+	}
+	return free, nil
+}
+
+// cgroupFree returns the memory left in the cgroup of the manager and its parents, limited is false if none
+// of them has a limit
+func (r *cgroupResources) cgroupFree() (free int64, limited bool, err error) {
+	base, dir, limitFile, usageFile, err := r.ownCgroup()
+	if err != nil {
+		return 0, false, err
+	}
+
+	for {
+		limit, err := readCgroupValue(filepath.Join(dir, limitFile))
+		// The root cgroup of cgroup v2 has no limit file
+		if err != nil && !os.IsNotExist(err) {
+			return 0, false, err
+		}
+		if err == nil && limit > 0 {
+			usage, err := readCgroupValue(filepath.Join(dir, usageFile))
+			if err != nil {
+				return 0, false, err
+			}
+			if !limited || limit-usage < free {
+				free, limited = limit-usage, true
+			}
+		}
+		if dir == base {
+			return free, limited, nil
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// ownCgroup finds the memory cgroup of the manager in /proc/self/cgroup. It returns the directory of the hierarchy,
+// the directory of the cgroup and the names of its limit and usage files. The memory controller line is a cgroup
+// v1 hierarchy, the 0:: line the unified cgroup v2 hierarchy, which is used if memory is no v1 controller.
+func (r *cgroupResources) ownCgroup() (string, string, string, string, error) {
+	file, err := ioutil.ReadFile(r.self)
+	if err != nil {
+		return "", "", "", "", err
+	}
+
+	var v2Path string
+	found := false
+	for _, line := range strings.Split(string(file), "\n") {
+		// Lines look like "4:memory:/system.slice/jam.service" or "0::/system.slice/jam.service"
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[0] == "0" && fields[1] == "" {
+			v2Path, found = fields[2], true
+			continue
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			if controller == "memory" {
+				base := filepath.Join(r.root, "memory")
+				return base, filepath.Join(base, fields[2]), "memory.limit_in_bytes", "memory.usage_in_bytes", nil
+			}
+		}
+	}
+	if !found {
+		return "", "", "", "", fmt.Errorf("No memory cgroup found in %s", r.self)
+	}
+	return r.root, filepath.Join(r.root, v2Path), "memory.max", "memory.current", nil
+}
+
+// readCgroupValue reads a value in bytes from a cgroup file, "max" means no limit and is returned as zero
+func readCgroupValue(path string) (int64, error) {
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	value := strings.TrimSpace(string(file))
+	if value == "max" {
+		return 0, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, path string, content string) {
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Fail: %s", err)
+	}
+}
+
+func TestMeminfoFreeMemory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "meminfo")
+	writeTestFile(t, path, "MemTotal:       16314208 kB\nMemFree:         1181364 kB\nMemAvailable:    8024412 kB\n")
+
+	r := &meminfoResources{path: path}
+	if free, err := r.FreeMemory(); err != nil || free != 8024412*1024 {
+		t.Errorf("Fail: expected %d, got %d, %v", 8024412*1024, free, err)
+	}
+}
+
+func TestCgroupFreeMemory(t *testing.T) {
+	dir := t.TempDir()
+	meminfo := filepath.Join(dir, "meminfo")
+	writeTestFile(t, meminfo, "MemAvailable:    8388608 kB\n")
+	self := filepath.Join(dir, "self")
+
+	// cgroup v2, the service has a MemoryMax= of 4GiB with 1GiB in use, its slice 8GiB with 2GiB in use
+	v2 := filepath.Join(dir, "v2")
+	writeTestFile(t, filepath.Join(v2, "system.slice", "memory.max"), "8589934592\n")
+	writeTestFile(t, filepath.Join(v2, "system.slice", "memory.current"), "2147483648\n")
+	writeTestFile(t, filepath.Join(v2, "system.slice", "jam.service", "memory.max"), "4294967296\n")
+	writeTestFile(t, filepath.Join(v2, "system.slice", "jam.service", "memory.current"), "1073741824\n")
+	writeTestFile(t, self, "0::/system.slice/jam.service\n")
+	r := &cgroupResources{root: v2, self: self, host: meminfoResources{path: meminfo}}
+	if free, err := r.FreeMemory(); err != nil || free != 3221225472 {
+		t.Errorf("Fail: expected %d, got %d, %v", 3221225472, free, err)
+	}
+
+	// The root cgroup of cgroup v2 has no memory.max
+	writeTestFile(t, self, "0::/\n")
+	if free, err := r.FreeMemory(); err != nil || free != 8388608*1024 {
+		t.Errorf("Fail: expected %d, got %d, %v", 8388608*1024, free, err)
+	}
+
+	// cgroup v1 in a hybrid setup, the memory controller is unlimited, which v1 reports as a huge value
+	v1 := filepath.Join(dir, "v1")
+	unlimited := "9223372036854771712\n"
+	writeTestFile(t, filepath.Join(v1, "memory", "memory.limit_in_bytes"), unlimited)
+	writeTestFile(t, filepath.Join(v1, "memory", "memory.usage_in_bytes"), "4294967296\n")
+	writeTestFile(t, filepath.Join(v1, "memory", "system.slice", "jam.service", "memory.limit_in_bytes"), unlimited)
+	writeTestFile(t, filepath.Join(v1, "memory", "system.slice", "jam.service", "memory.usage_in_bytes"), "1073741824\n")
+	writeTestFile(t, self, "12:cpu,cpuacct:/system.slice/jam.service\n4:memory:/system.slice/jam.service\n0::/system.slice/jam.service\n")
+	r = &cgroupResources{root: v1, self: self, host: meminfoResources{path: meminfo}}
+	if free, err := r.FreeMemory(); err != nil || free != 8388608*1024 {
+		t.Errorf("Fail: expected %d, got %d, %v", 8388608*1024, free, err)
+	}
+
+	// A MemoryMax= of 2GiB with 1.5GiB in use
+	writeTestFile(t, filepath.Join(v1, "memory", "system.slice", "jam.service", "memory.limit_in_bytes"), "2147483648\n")
+	writeTestFile(t, filepath.Join(v1, "memory", "system.slice", "jam.service", "memory.usage_in_bytes"), "1610612736\n")
+	if free, err := r.FreeMemory(); err != nil || free != 536870912 {
+		t.Errorf("Fail: expected %d, got %d, %v", 536870912, free, err)
+	}
+}
+
+func TestJenkinsFreeMemoryBuiltInNode(t *testing.T) {
+	mj := mockJenkins(4096)
+	defer mj.Close()
+	jc, _ := NewJenkinsConnector(mj.URL, "", "")
+
+	r := &jenkinsResources{jc: jc}
+	if free, err := r.FreeMemory(); err != nil || free != 4096 {
+		t.Errorf("Fail: expected 4096, got %d, %v", free, err)
+	}
+	r = &jenkinsResources{jc: jc, node: "build-host"}
+	if _, err := r.FreeMemory(); err != ErrNodeNotFound {
+		t.Errorf("Fail: expected %s, got %v", ErrNodeNotFound, err)
+	}
+}
@@ -0,0 +1,257 @@
+/*
+ *
+ * Copyright [2014] [Jörn Domnik]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Defaults of the requests to the Jenkins API
+const (
+	defaultJenkinsTimeout = 30 * time.Second
+	defaultJenkinsRetries = 3
+	defaultJenkinsBackoff = 500 * time.Millisecond
+)
+
+// The circuit breaker opens after breakerThreshold requests in a row failed and stays open for breakerCooldown
+const (
+	breakerThreshold = 5
+	breakerCooldown  = 30 * time.Second
+)
+
+var (
+	// ErrJenkinsAuth indicates that Jenkins rejected the credentials of jenkins_api_user or its permissions don't
+	// suffice
+	ErrJenkinsAuth = errors.New("Jenkins rejected the credentials or permissions of jenkins_api_user")
+	// ErrJenkinsNotFound indicates that the requested resource doesn't exist at Jenkins
+	ErrJenkinsNotFound = errors.New("Jenkins doesn't know the requested resource")
+	// ErrJenkinsUnavailable indicates that requests fail fast because the last requests to Jenkins failed
+	ErrJenkinsUnavailable = errors.New("Jenkins is unavailable, requests fail fast until it recovers")
+)
+
+// JenkinsError is an error status Jenkins answered a request with. It matches ErrJenkinsAuth and
+// ErrJenkinsNotFound with errors.Is.
+type JenkinsError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Status     string
+}
+
+func (e *JenkinsError) Error() string {
+	return fmt.Sprintf("Jenkins answered %s %s with status %s", e.Method, e.Path, e.Status)
+}
+
+func (e *JenkinsError) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrJenkinsAuth
+	case http.StatusNotFound:
+		return ErrJenkinsNotFound
+	}
+	return nil
+}
+
+// unavailable reports whether err means that Jenkins is down or overloaded, i.e. a network error, a timeout or a 5xx
+// answer. An error status like 404 means Jenkins works.
+func unavailable(err error) bool {
+	var je *JenkinsError
+	if errors.As(err, &je) {
+		return je.StatusCode >= http.StatusInternalServerError
+	}
+	return err != nil
+}
+
+// retryable reports whether a request that failed with err may be sent again. GETs are retried on every error
+// that means Jenkins is unavailable. POSTs aren't idempotent, toggling a node offline twice brings it back online,
+// so they are only retried if Jenkins didn't process them.
+func retryable(method string, err error) bool {
+	if method == http.MethodGet {
+		return unavailable(err)
+	}
+	var je *JenkinsError
+	if errors.As(err, &je) {
+		return je.StatusCode == http.StatusBadGateway || je.StatusCode == http.StatusServiceUnavailable ||
+			je.StatusCode == http.StatusGatewayTimeout
+	}
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// breaker is the circuit breaker of the requests to Jenkins. Once threshold requests in a row found Jenkins
+// unavailable it opens, every request fails with ErrJenkinsUnavailable right away instead of waiting for the
+// timeouts and retries. After cooldown requests are sent again, the first one failing opens it again.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// allow returns ErrJenkinsUnavailable while the breaker is open
+func (b *breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Now().Before(b.openUntil) {
+		return ErrJenkinsUnavailable
+	}
+	return nil
+}
+
+// record counts the result of a request
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !unavailable(err) {
+		if b.failures >= b.threshold {
+			log.Println("[JENKINS]: Jenkins is available again.")
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		log.Printf("[JENKINS]: ERROR: %d requests in a row failed, failing fast for %s. Error: %s\n", b.failures, b.cooldown, err.Error())
+	}
+}
+
+// Available returns ErrJenkinsUnavailable while the circuit breaker is open, so callers can fail fast before they
+// start work that needs Jenkins
+func (jc *JenkinsConnector) Available() error {
+	return jc.breaker.allow()
+}
+
+// get requests path from the Jenkins API and returns the response body
+func (jc *JenkinsConnector) get(path string) ([]byte, error) {
+	return jc.request(http.MethodGet, path, nil, nil)
+}
+
+// post sends the form to path of the Jenkins API with a CSRF crumb and returns the response body
+func (jc *JenkinsConnector) post(path string, form url.Values) ([]byte, error) {
+	c, err := jc.crumb()
+	if err != nil {
+		return nil, err
+	}
+	return jc.request(http.MethodPost, path, form, c)
+}
+
+// crumb is the CSRF protection token Jenkins expects with every POST
+type crumb struct {
+	RequestField string `json:"crumbRequestField"`
+	Crumb        string `json:"crumb"`
+}
+
+// crumb fetches a CSRF crumb from the crumb issuer, it's nil if CSRF protection is disabled in Jenkins
+func (jc *JenkinsConnector) crumb() (*crumb, error) {
+	body, err := jc.get("/crumbIssuer/api/json")
+	// Without CSRF protection there is no crumb issuer
+	if errors.Is(err, ErrJenkinsNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var c crumb
+	if err := json.Unmarshal(body, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// request sends a request to path of the Jenkins API and retries it with exponential backoff as long as it's
+// retryable. It fails right away while the circuit breaker is open.
+func (jc *JenkinsConnector) request(method string, path string, form url.Values, c *crumb) ([]byte, error) {
+	if err := jc.breaker.allow(); err != nil {
+		return nil, err
+	}
+
+	backoff := jc.Backoff
+	for attempt := 0; ; attempt++ {
+		body, err := jc.attempt(method, path, form, c)
+		if err == nil || attempt >= jc.Retries || !retryable(method, err) {
+			jc.breaker.record(err)
+			return body, err
+		}
+		log.Printf("[JENKINS]: %s %s failed, retrying in %s. Error: %s\n", method, path, backoff, err.Error())
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// attempt sends a request to path of the Jenkins API with the credentials of the connector once, the form is
+// sent as body and the crumb as header if they are set
+func (jc *JenkinsConnector) attempt(method string, path string, form url.Values, c *crumb) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), jc.Timeout)
+	defer cancel()
+
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, jc.BaseUrl+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if jc.User != "" {
+		req.SetBasicAuth(jc.User, jc.AuthToken)
+	}
+	if c != nil {
+		req.Header.Set(c.RequestField, c.Crumb)
+	}
+
+	start := time.Now()
+	resp, err := jc.client.Do(req)
+	if err == nil {
+		body, err := readResponse(method, path, resp)
+		observeJenkinsRequest(method, start, err)
+		return body, err
+	}
+	observeJenkinsRequest(method, start, err)
+	return nil, err
+}
+
+// readResponse returns the body of the response, or a JenkinsError if Jenkins answered with an error status.
+// The body of an error is an HTML page, it's never parsed.
+func readResponse(method string, path string, resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, &JenkinsError{method, path, resp.StatusCode, resp.Status}
+	}
+	return ioutil.ReadAll(resp.Body)
+}
@@ -20,10 +20,27 @@ package main
 
 import (
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// nodeDescription marks the Jenkins nodes created by the manager
+const nodeDescription = "Managed by jenkins-agent-manager"
+
+var (
+	// ErrNoAgentSecret indicates that Jenkins didn't hand out a secret for an agent
+	ErrNoAgentSecret = errors.New("No agent secret found in the JNLP file")
+	// ErrNodeNotFound indicates that Jenkins doesn't know the requested node
+	ErrNodeNotFound = errors.New("No Jenkins node with the specified name found")
+	// ErrNoMonitorData indicates that Jenkins has no memory monitor data for the node, e.g. because it's offline
+	ErrNoMonitorData = errors.New("No memory monitor data for the Jenkins node available")
 )
 
 type hudsonSwapSpaceMonitor struct {
@@ -34,22 +51,72 @@ type hudsonSwapSpaceMonitor struct {
 }
 
 type computerMonitorData struct {
-	SwapSpaceMonitor hudsonSwapSpaceMonitor `json:"hudson.node_monitors.SwapSpaceMonitor"`
+	SwapSpaceMonitor *hudsonSwapSpaceMonitor `json:"hudson.node_monitors.SwapSpaceMonitor"`
+}
+
+// executable is the build an executor is currently running
+type executable struct {
+	Number int    `json:"number"`
+	URL    string `json:"url"`
 }
 
 type executor struct {
-	CurrentExecutable string `json:"currentExecutable"`
-	CurrentWorkUnit   string `json:"currentWorkUnit"`
-	Idle              bool   `json:"idle"`
-	LikelyStuck       bool   `json:"likelyStuck"`
-	Number            int    `json:"number"`
-	Progress          int    `json:"progress"`
+	CurrentExecutable *executable     `json:"currentExecutable"`
+	CurrentWorkUnit   json.RawMessage `json:"currentWorkUnit"`
+	Idle              bool            `json:"idle"`
+	LikelyStuck       bool            `json:"likelyStuck"`
+	Number            int             `json:"number"`
+	Progress          int             `json:"progress"`
 }
 
 type computer struct {
-	DisplayName string              `json:"displayName"`
-	MonitorData computerMonitorData `json:"monitorData"`
-	Executors   []executor          `json:"executors"`
+	Class              string              `json:"_class"`
+	DisplayName        string              `json:"displayName"`
+	Description        string              `json:"description"`
+	Idle               bool                `json:"idle"`
+	Offline            bool                `json:"offline"`
+	TemporarilyOffline bool                `json:"temporarilyOffline"`
+	OfflineCauseReason string              `json:"offlineCauseReason"`
+	MonitorData        computerMonitorData `json:"monitorData"`
+	Executors          []executor          `json:"executors"`
+}
+
+// builtIn reports whether the computer is the node Jenkins itself runs on, it's called "master" in older
+// and "Built-In Node" in newer versions of Jenkins
+func (c *computer) builtIn() bool {
+	if c.Class != "" {
+		return c.Class == "hudson.model.Hudson$MasterComputer"
+	}
+	return c.DisplayName == "master" || c.DisplayName == "Built-In Node"
+}
+
+// managed reports whether the node of the computer was created by the manager
+func (c *computer) managed() bool {
+	return c.Description == nodeDescription
+}
+
+// allIdle reports whether the computer is online and none of its executors is running a build
+func (c *computer) allIdle() bool {
+	if c.Offline {
+		return false
+	}
+	for _, e := range c.Executors {
+		if !e.Idle {
+			return false
+		}
+	}
+	return true
+}
+
+// builds returns the URLs of the builds the executors of the computer are running
+func (c *computer) builds() []string {
+	var urls []string
+	for _, e := range c.Executors {
+		if e.CurrentExecutable != nil {
+			urls = append(urls, e.CurrentExecutable.URL)
+		}
+	}
+	return urls
 }
 
 type ComputerInfo struct {
@@ -58,26 +125,98 @@ type ComputerInfo struct {
 	Computers      []computer `json:"computer"`
 }
 
+// computer returns the computer with the given name
+func (computerInfo *ComputerInfo) computer(name string) (*computer, bool) {
+	for i := range computerInfo.Computers {
+		if computerInfo.Computers[i].DisplayName == name {
+			return &computerInfo.Computers[i], true
+		}
+	}
+	return nil, false
+}
+
+type queueLabel struct {
+	Name string `json:"name"`
+}
+
+type queueTask struct {
+	Name          string      `json:"name"`
+	URL           string      `json:"url"`
+	AssignedLabel *queueLabel `json:"assignedLabel"`
+}
+
+type queueItem struct {
+	ID           int       `json:"id"`
+	Blocked      bool      `json:"blocked"`
+	Buildable    bool      `json:"buildable"`
+	Stuck        bool      `json:"stuck"`
+	Why          string    `json:"why"`
+	InQueueSince int64     `json:"inQueueSince"`
+	Task         queueTask `json:"task"`
+}
+
+// QueueInfo is the build queue as returned by /queue/api/json
+type QueueInfo struct {
+	Items []queueItem `json:"items"`
+}
+
+// whyLabel extracts the label from messages like "Waiting for next available executor on ‘linux’"
+var whyLabel = regexp.MustCompile(`[‘'"]([^’'"]+)[’'"]`)
+
+// Label returns the label expression the item is waiting for, or an empty string if it's unknown
+func (item *queueItem) Label() string {
+	if item.Task.AssignedLabel != nil && item.Task.AssignedLabel.Name != "" {
+		return item.Task.AssignedLabel.Name
+	}
+	if m := whyLabel.FindStringSubmatch(item.Why); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// jnlpFile is the part of the JNLP file of an agent holding its connection arguments
+type jnlpFile struct {
+	Arguments []string `xml:"application-desc>argument"`
+}
+
+// JenkinsConnector talks to the Jenkins API. It authenticates with HTTP basic auth as User with the API token
+// AuthToken, requests are anonymous if no user is set. A single connector is shared by all components, so they
+// share its circuit breaker as well.
 type JenkinsConnector struct {
 	BaseUrl   string
+	User      string
 	AuthToken string
-}
+	// Timeout is the deadline of a single attempt of a request
+	Timeout time.Duration
+	// Retries is how often a failed request is retried, Backoff the wait before the first retry which doubles
+	// with every further retry
+	Retries int
+	Backoff time.Duration
 
-func NewJenkinsConnector(baseUrl string, authToken string) (*JenkinsConnector, error) {
-	return &JenkinsConnector{baseUrl, authToken}, nil
+	client  *http.Client
+	breaker breaker
 }
 
-func (jc *JenkinsConnector) requestComputerInfo() (*ComputerInfo, error) {
-	url := buildUrl(jc.BaseUrl, jc.AuthToken, "/computer/api/json?depth=2")
-
-	resp, err := http.Get(url)
-	fmt.Println(url)
+func NewJenkinsConnector(baseUrl string, user string, authToken string) (*JenkinsConnector, error) {
+	// Jenkins binds crumbs to the session, the session cookie has to be sent with the POST the crumb is for
+	jar, err := cookiejar.New(nil)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	return &JenkinsConnector{
+		BaseUrl:   baseUrl,
+		User:      user,
+		AuthToken: authToken,
+		Timeout:   defaultJenkinsTimeout,
+		Retries:   defaultJenkinsRetries,
+		Backoff:   defaultJenkinsBackoff,
+		client:    &http.Client{Jar: jar},
+		breaker:   breaker{threshold: breakerThreshold, cooldown: breakerCooldown},
+	}, nil
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
+func (jc *JenkinsConnector) requestComputerInfo() (*ComputerInfo, error) {
+	body, err := jc.get("/computer/api/json?depth=2")
 	if err != nil {
 		return nil, err
 	}
@@ -90,8 +229,137 @@ func (jc *JenkinsConnector) requestComputerInfo() (*ComputerInfo, error) {
 	return &j, err
 }
 
-func buildUrl(url string, token string, path string) string {
-	return url + path + "&token=" + token
+// GetQueue returns the current build queue of Jenkins
+func (jc *JenkinsConnector) GetQueue() (*QueueInfo, error) {
+	body, err := jc.get("/queue/api/json")
+	if err != nil {
+		return nil, err
+	}
+
+	var q QueueInfo
+	if err := json.Unmarshal(body, &q); err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// GetComputerInfo returns the computers known to Jenkins with their executors
+func (jc *JenkinsConnector) GetComputerInfo() (*ComputerInfo, error) {
+	return jc.requestComputerInfo()
+}
+
+// CreateNode registers a permanent JNLP agent with the given name, labels, remote root directory, number of
+// executors and class of its retention strategy at Jenkins
+func (jc *JenkinsConnector) CreateNode(name string, labels []string, remoteFS string, executors int, retention string) error {
+	node := map[string]interface{}{
+		"name":            name,
+		"nodeDescription": nodeDescription,
+		"numExecutors":    executors,
+		"remoteFS":        remoteFS,
+		"labelString":     strings.Join(labels, " "),
+		"mode":            "NORMAL",
+		"type":            "hudson.slaves.DumbSlave",
+		"launcher": map[string]string{
+			"stapler-class": "hudson.slaves.JNLPLauncher",
+			"$class":        "hudson.slaves.JNLPLauncher",
+		},
+		"retentionStrategy": map[string]string{
+			"stapler-class": retention,
+			"$class":        retention,
+		},
+		"nodeProperties": map[string]string{"stapler-class-bag": "true"},
+	}
+	nodeJson, err := json.Marshal(node)
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{}
+	form.Set("name", name)
+	form.Set("type", "hudson.slaves.DumbSlave")
+	form.Set("json", string(nodeJson))
+	_, err = jc.post("/computer/doCreateItem", form)
+	return err
+}
+
+// buildFeed is the Atom feed of the builds a node ran
+type buildFeed struct {
+	Entries []struct {
+		Links []struct {
+			Rel  string `xml:"rel,attr"`
+			Href string `xml:"href,attr"`
+		} `xml:"link"`
+	} `xml:"entry"`
+}
+
+// GetBuildHistory returns the URLs of the builds the node with the given name ran, the running ones included.
+// They are read from the feed of the build history Jenkins shows at /computer/<name>/builds.
+func (jc *JenkinsConnector) GetBuildHistory(name string) ([]string, error) {
+	body, err := jc.get("/computer/" + url.PathEscape(name) + "/rssAll")
+	if err != nil {
+		return nil, err
+	}
+
+	var feed buildFeed
+	if err := xml.Unmarshal(body, &feed); err != nil {
+		return nil, err
+	}
+	var urls []string
+	for _, e := range feed.Entries {
+		for _, l := range e.Links {
+			if l.Rel == "" || l.Rel == "alternate" {
+				urls = append(urls, l.Href)
+				break
+			}
+		}
+	}
+	return urls, nil
+}
+
+// GetAgentSecret returns the secret the agent with the given name needs to connect to Jenkins
+func (jc *JenkinsConnector) GetAgentSecret(name string) (string, error) {
+	body, err := jc.get("/computer/" + url.PathEscape(name) + "/slave-agent.jnlp")
+	if err != nil {
+		return "", err
+	}
+
+	var jnlp jnlpFile
+	if err := xml.Unmarshal(body, &jnlp); err != nil {
+		return "", err
+	}
+	if len(jnlp.Arguments) == 0 {
+		return "", ErrNoAgentSecret
+	}
+	// The first argument is the secret, the second the name of the agent
+	return jnlp.Arguments[0], nil
+}
+
+// DeleteNode removes the node with the given name from Jenkins
+func (jc *JenkinsConnector) DeleteNode(name string) error {
+	_, err := jc.post("/computer/"+url.PathEscape(name)+"/doDelete", url.Values{})
+	return err
+}
+
+// SetTemporarilyOffline takes the node with the given name temporarily offline with message as reason, or brings
+// it back online. Running builds aren't affected, but the node doesn't accept new builds while it's offline.
+func (jc *JenkinsConnector) SetTemporarilyOffline(name string, offline bool, message string) error {
+	body, err := jc.get("/computer/" + url.PathEscape(name) + "/api/json")
+	if err != nil {
+		return err
+	}
+	var c computer
+	if err := json.Unmarshal(body, &c); err != nil {
+		return err
+	}
+	// Jenkins only offers to toggle the state
+	if c.TemporarilyOffline == offline {
+		return nil
+	}
+
+	form := url.Values{}
+	form.Set("offlineMessage", message)
+	_, err = jc.post("/computer/"+url.PathEscape(name)+"/toggleOffline", form)
+	return err
 }
 
 func (computerInfo *ComputerInfo) PrettyPrint() {
@@ -100,6 +368,9 @@ func (computerInfo *ComputerInfo) PrettyPrint() {
 		fmt.Printf("BusyExecutors: %d\nTotalExecutors: %d\n", computerInfo.BusyExecutors, computerInfo.TotalExecutors)
 		fmt.Printf("\n===== DisplayName: %s ======\n", c.DisplayName)
 		swm := c.MonitorData.SwapSpaceMonitor
+		if swm == nil {
+			continue
+		}
 		fmt.Printf("TotalPhysicalMemory %d\n", swm.TotalPhysicalMemory)
 		fmt.Printf("AvailablePhysicalMemory: %d\n", swm.AvailablePhysicalMemory)
 		fmt.Printf("AvailableSwapSpace: %d\n", swm.AvailableSwapSpace)
@@ -107,16 +378,22 @@ func (computerInfo *ComputerInfo) PrettyPrint() {
 	}
 }
 
-func (jc *JenkinsConnector) GetFreeSystemMemory() (int64, error) {
+// GetFreeSystemMemory returns the available physical memory the Jenkins monitor reports for the node with
+// the given name, or for the built-in node if name is empty
+func (jc *JenkinsConnector) GetFreeSystemMemory(name string) (int64, error) {
 	c, err := jc.requestComputerInfo()
 	if err != nil {
 		return 0, err
 	}
 	for _, v := range c.Computers {
-		if v.DisplayName == "master" {
-			return v.MonitorData.SwapSpaceMonitor.AvailablePhysicalMemory, nil
+		if (name == "" && v.builtIn()) || (name != "" && v.DisplayName == name) {
+			if v.MonitorData.SwapSpaceMonitor == nil {
+				return 0, ErrNoMonitorData
+			}
+			free := v.MonitorData.SwapSpaceMonitor.AvailablePhysicalMemory
+			jenkinsFreeMemory.Set(float64(free))
+			return free, nil
 		}
 	}
-	err = errors.New("Internal error")
-	return 0, err
+	return 0, ErrNodeNotFound
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestJenkinsAuth(t *testing.T) {
+	mj := mockJenkins(4096)
+	defer mj.Close()
+	mj.user, mj.token = "jam", "11aa22bb"
+
+	jc, _ := NewJenkinsConnector(mj.URL, "jam", "11aa22bb")
+	if err := jc.CreateNode("linux-1", []string{"linux"}, "/home/vagrant/jenkins", 1, defaultRetentionStrategy); err != nil {
+		t.Fatalf("Fail: expected the node to be created with basic auth and crumb, got %s", err)
+	}
+	if err := jc.DeleteNode("linux-1"); err != nil {
+		t.Errorf("Fail: expected the node to be deleted, got %s", err)
+	}
+	if len(mj.created) != 1 || len(mj.deleted) != 1 {
+		t.Errorf("Fail: expected one created and one deleted node, got %v and %v", mj.created, mj.deleted)
+	}
+
+	jc, _ = NewJenkinsConnector(mj.URL, "jam", "wrong")
+	if _, err := jc.GetComputerInfo(); err == nil {
+		t.Errorf("Fail: expected a wrong token to be rejected")
+	}
+}
+
+func TestJenkinsWithoutCrumbIssuer(t *testing.T) {
+	var crumbHeader string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/crumbIssuer/api/json" {
+			http.NotFound(w, r)
+			return
+		}
+		crumbHeader = r.Header.Get("Jenkins-Crumb")
+	}))
+	defer server.Close()
+
+	jc, _ := NewJenkinsConnector(server.URL, "", "")
+	if err := jc.DeleteNode("linux-1"); err != nil {
+		t.Errorf("Fail: expected a POST without crumb if CSRF protection is disabled, got %s", err)
+	}
+	if crumbHeader != "" {
+		t.Errorf("Fail: expected no crumb, got %s", crumbHeader)
+	}
+}
+
+func TestJenkinsRetries(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		switch {
+		case r.URL.Path == "/queue/api/json" && requests < 3:
+			http.Error(w, "Jenkins is starting", http.StatusServiceUnavailable)
+		case r.URL.Path == "/queue/api/json":
+			fmt.Fprint(w, `{"items":[]}`)
+		default:
+			http.Error(w, "<html>Forbidden</html>", http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	jc, _ := NewJenkinsConnector(server.URL, "", "")
+	jc.Backoff = time.Millisecond
+	if _, err := jc.GetQueue(); err != nil || requests != 3 {
+		t.Errorf("Fail: expected the queue after 2 retries, got %d requests, %v", requests, err)
+	}
+
+	requests = 0
+	if _, err := jc.GetComputerInfo(); !errors.Is(err, ErrJenkinsAuth) || requests != 1 {
+		t.Errorf("Fail: expected %s without retries, got %d requests, %v", ErrJenkinsAuth, requests, err)
+	}
+}
+
+func TestJenkinsBreaker(t *testing.T) {
+	fp := &fakeProvisioner{boxMemory: 1024}
+	contr, mj := mockController(t, fp, 4096)
+	jc := contr.JenkinsConnector
+	jc.Retries = 0
+	jc.breaker.threshold = 2
+	// Jenkins goes down
+	mj.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := jc.GetComputerInfo(); err == nil || err == ErrJenkinsUnavailable {
+			t.Errorf("Fail: expected the request %d to be sent and fail, got %v", i, err)
+		}
+	}
+	if _, err := jc.GetComputerInfo(); err != ErrJenkinsUnavailable {
+		t.Errorf("Fail: expected %s once the breaker is open, got %v", ErrJenkinsUnavailable, err)
+	}
+	if err := contr.StartVms("windows", io.Discard); err != ErrJenkinsUnavailable || len(fp.started) != 0 {
+		t.Errorf("Fail: expected the start to fail fast with %s, got %v", ErrJenkinsUnavailable, err)
+	}
+
+	// After the cooldown the next request is sent again
+	jc.breaker.cooldown = 0
+	jc.breaker.openUntil = time.Time{}
+	if _, err := jc.GetComputerInfo(); err == ErrJenkinsUnavailable {
+		t.Errorf("Fail: expected the request to be sent after the cooldown")
+	}
+}
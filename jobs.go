@@ -0,0 +1,263 @@
+/*
+ *
+ * Copyright [2014] [Jörn Domnik]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrJobNotFound indicates that no job with the requested id is known
+	ErrJobNotFound = errors.New("No job with the specified id found")
+	// ErrShuttingDown indicates that the queue doesn't take or run jobs anymore because the manager shuts down
+	ErrShuttingDown = errors.New("The manager is shutting down")
+)
+
+// JobState is the state a job is in
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+)
+
+// Kinds of jobs the controller enqueues
+const (
+	JobStart   = "start"
+	JobDestroy = "destroy"
+	JobReset   = "reset"
+)
+
+// Finished jobs are forgotten after this period
+const jobRetention = 24 * time.Hour
+
+// Job is a start or destroy request that is executed in the background
+type Job struct {
+	ID         string     `json:"id"`
+	Kind       string     `json:"kind"`
+	Label      string     `json:"label,omitempty"`
+	InstanceID string     `json:"instance_id,omitempty"`
+	State      JobState   `json:"state"`
+	Error      string     `json:"error,omitempty"`
+	Output     string     `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	run func(out io.Writer) error
+	out *jobOutput
+}
+
+// jobOutput collects the output of the commands a job runs, it can be read while the job is still running
+type jobOutput struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (o *jobOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.buf.Write(p)
+}
+
+func (o *jobOutput) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.buf.String()
+}
+
+// JobQueue runs submitted jobs with a fixed number of workers and keeps their results
+type JobQueue struct {
+	mu    sync.Mutex
+	jobs  map[string]*Job
+	queue chan *Job
+	// running counts the running jobs, closed is set once the queue shuts down
+	running sync.WaitGroup
+	closed  bool
+}
+
+// NewJobQueue creates a JobQueue and starts its workers
+func NewJobQueue(workers int) *JobQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	q := &JobQueue{jobs: make(map[string]*Job), queue: make(chan *Job, 128)}
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+	return q
+}
+
+// Submit enqueues fn as a new job and returns a copy of the job right away
+func (q *JobQueue) Submit(kind string, label string, instanceID string, fn func(out io.Writer) error) (Job, error) {
+	id, err := newRandomID()
+	if err != nil {
+		return Job{}, err
+	}
+	j := &Job{
+		ID:         id,
+		Kind:       kind,
+		Label:      label,
+		InstanceID: instanceID,
+		State:      JobQueued,
+		CreatedAt:  time.Now(),
+		run:        fn,
+		out:        new(jobOutput),
+	}
+
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return Job{}, ErrShuttingDown
+	}
+	q.prune()
+	q.jobs[id] = j
+	snapshot := q.snapshot(j)
+	q.mu.Unlock()
+
+	log.Printf("[JOBS]: Queued %s job %s.\n", kind, id)
+	q.queue <- j
+	return snapshot, nil
+}
+
+// Get returns a copy of the job with the given id
+func (q *JobQueue) Get(id string) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	j, ok := q.jobs[id]
+	if !ok {
+		return Job{}, ErrJobNotFound
+	}
+	return q.snapshot(j), nil
+}
+
+// Pending returns the number of queued or running jobs of the kind, matching label and instanceID
+// if they aren't empty
+func (q *JobQueue) Pending(kind string, label string, instanceID string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var count int
+	for _, j := range q.jobs {
+		if j.Kind != kind || (j.State != JobQueued && j.State != JobRunning) {
+			continue
+		}
+		if (label != "" && j.Label != label) || (instanceID != "" && j.InstanceID != instanceID) {
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+func (q *JobQueue) worker() {
+	for j := range q.queue {
+		q.execute(j)
+	}
+}
+
+func (q *JobQueue) execute(j *Job) {
+	started := time.Now()
+	q.mu.Lock()
+	// Jobs still queued when the queue shut down have been failed already
+	if j.State != JobQueued {
+		q.mu.Unlock()
+		return
+	}
+	j.State = JobRunning
+	j.StartedAt = &started
+	q.running.Add(1)
+	q.mu.Unlock()
+	defer q.running.Done()
+
+	log.Printf("[JOBS]: Running %s job %s.\n", j.Kind, j.ID)
+	err := j.run(j.out)
+
+	finished := time.Now()
+	q.mu.Lock()
+	j.FinishedAt = &finished
+	if err != nil {
+		j.State = JobFailed
+		j.Error = err.Error()
+	} else {
+		j.State = JobSucceeded
+	}
+	q.mu.Unlock()
+
+	if err != nil {
+		log.Printf("[JOBS]: %s job %s failed. Error: %s\n", j.Kind, j.ID, err.Error())
+		return
+	}
+	log.Printf("[JOBS]: %s job %s succeeded.\n", j.Kind, j.ID)
+}
+
+// Shutdown stops taking new jobs, fails the queued jobs and waits until the running jobs are finished or ctx
+// is done. It can be called again to keep waiting for the running jobs.
+func (q *JobQueue) Shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	q.closed = true
+	now := time.Now()
+	for _, j := range q.jobs {
+		if j.State == JobQueued {
+			j.State = JobFailed
+			j.Error = ErrShuttingDown.Error()
+			j.FinishedAt = &now
+			log.Printf("[JOBS]: Cancelled the queued %s job %s.\n", j.Kind, j.ID)
+		}
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// snapshot copies the exported fields of a job, q.mu has to be held by the caller
+func (q *JobQueue) snapshot(j *Job) Job {
+	c := *j
+	c.Output = j.out.String()
+	c.run = nil
+	c.out = nil
+	return c
+}
+
+// prune removes finished jobs older than the retention period, q.mu has to be held by the caller
+func (q *JobQueue) prune() {
+	for id, j := range q.jobs {
+		if j.FinishedAt != nil && time.Since(*j.FinishedAt) > jobRetention {
+			delete(q.jobs, id)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestJobQueueShutdown(t *testing.T) {
+	q := NewJobQueue(1)
+	release := make(chan struct{})
+	running, _ := q.Submit(JobStart, "windows", "", func(out io.Writer) error {
+		<-release
+		return nil
+	})
+	queued, _ := q.Submit(JobStart, "windows", "", func(out io.Writer) error { return nil })
+	for i := 0; i < 100; i++ {
+		if j, _ := q.Get(running.ID); j.State == JobRunning {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := q.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Fail: expected the shutdown to wait for the running job, got %v", err)
+	}
+	if j, _ := q.Get(queued.ID); j.State != JobFailed || j.Error != ErrShuttingDown.Error() {
+		t.Errorf("Fail: expected the queued job to be cancelled, got %+v", j)
+	}
+	if _, err := q.Submit(JobStart, "windows", "", nil); err != ErrShuttingDown {
+		t.Errorf("Fail: expected %s, got %v", ErrShuttingDown, err)
+	}
+
+	close(release)
+	if err := q.Shutdown(context.Background()); err != nil {
+		t.Errorf("Fail: %s", err)
+	}
+	if j, _ := q.Get(running.ID); j.State != JobSucceeded {
+		t.Errorf("Fail: expected the running job to finish, got %+v", j)
+	}
+}
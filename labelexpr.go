@@ -0,0 +1,253 @@
+/*
+ *
+ * Copyright [2014] [Jörn Domnik]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+/*
+ * Parser and evaluator for Jenkins label expressions like "windows && x64" or "(linux || centos) && !arm".
+ * The operators are, from the highest to the lowest precedence:
+ *   !    not
+ *   &&   and
+ *   ||   or
+ *   ->   implies
+ *   <->  if and only if
+ * Labels containing operator characters or spaces can be quoted with double quotes.
+ */
+
+// labelExpr is a parsed label expression
+type labelExpr interface {
+	// eval reports whether a node with the given labels satisfies the expression
+	eval(labels map[string]bool) bool
+}
+
+type labelAtom string
+
+func (a labelAtom) eval(labels map[string]bool) bool {
+	return labels[string(a)]
+}
+
+type labelNot struct {
+	expr labelExpr
+}
+
+func (n labelNot) eval(labels map[string]bool) bool {
+	return !n.expr.eval(labels)
+}
+
+type labelBinary struct {
+	op          string
+	left, right labelExpr
+}
+
+func (b labelBinary) eval(labels map[string]bool) bool {
+	l, r := b.left.eval(labels), b.right.eval(labels)
+	switch b.op {
+	case "&&":
+		return l && r
+	case "||":
+		return l || r
+	case "->":
+		return !l || r
+	case "<->":
+		return l == r
+	}
+	return false
+}
+
+// matchLabels reports whether a node with the given labels satisfies the label expression
+func matchLabels(expr string, labels []string) (bool, error) {
+	e, err := parseLabelExpr(expr)
+	if err != nil {
+		return false, err
+	}
+	set := make(map[string]bool, len(labels))
+	for _, l := range labels {
+		set[l] = true
+	}
+	return e.eval(set), nil
+}
+
+// parseLabelExpr parses a Jenkins label expression
+func parseLabelExpr(expr string) (labelExpr, error) {
+	tokens, err := tokenizeLabelExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("Empty label expression")
+	}
+
+	p := &labelParser{tokens: tokens}
+	e, err := p.parseBinary(0)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid label expression %q: %s", expr, err.Error())
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("Invalid label expression %q: unexpected %q", expr, p.tokens[p.pos].text)
+	}
+	return e, nil
+}
+
+type labelToken struct {
+	text string
+	// atom is set for labels, so a quoted label like "&&" isn't taken for an operator
+	atom bool
+}
+
+// labelOperators are the binary operators ordered from the lowest to the highest precedence
+var labelOperators = []string{"<->", "->", "||", "&&"}
+
+func tokenizeLabelExpr(expr string) ([]labelToken, error) {
+	var tokens []labelToken
+	for i := 0; i < len(expr); {
+		rest := expr[i:]
+		switch {
+		case unicode.IsSpace(rune(expr[i])):
+			i++
+		case strings.HasPrefix(rest, "<->"):
+			tokens = append(tokens, labelToken{text: "<->"})
+			i += 3
+		case strings.HasPrefix(rest, "->"), strings.HasPrefix(rest, "&&"), strings.HasPrefix(rest, "||"):
+			tokens = append(tokens, labelToken{text: rest[:2]})
+			i += 2
+		case expr[i] == '!' || expr[i] == '(' || expr[i] == ')':
+			tokens = append(tokens, labelToken{text: rest[:1]})
+			i++
+		case expr[i] == '"':
+			atom, n, err := scanQuotedLabel(rest)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, labelToken{text: atom, atom: true})
+			i += n
+		default:
+			n := scanLabel(rest)
+			if n == 0 {
+				return nil, fmt.Errorf("Unexpected character %q in label expression %q", expr[i], expr)
+			}
+			tokens = append(tokens, labelToken{text: rest[:n], atom: true})
+			i += n
+		}
+	}
+	return tokens, nil
+}
+
+// scanLabel returns the length of the unquoted label at the start of s. Labels may contain a '-' as long
+// as it doesn't start an operator
+func scanLabel(s string) int {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if unicode.IsSpace(rune(c)) || strings.IndexByte("&|!()\"", c) >= 0 {
+			return i
+		}
+		if strings.HasPrefix(s[i:], "->") || strings.HasPrefix(s[i:], "<->") {
+			return i
+		}
+	}
+	return len(s)
+}
+
+// scanQuotedLabel returns the unquoted label and the length of the quoted label at the start of s
+func scanQuotedLabel(s string) (string, int, error) {
+	var label []byte
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				label = append(label, s[i])
+			}
+		case '"':
+			return string(label), i + 1, nil
+		default:
+			label = append(label, s[i])
+		}
+	}
+	return "", 0, fmt.Errorf("Unterminated quote in label expression %q", s)
+}
+
+type labelParser struct {
+	tokens []labelToken
+	pos    int
+}
+
+func (p *labelParser) peek() (labelToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return labelToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+// parseBinary parses the left associative binary operators starting with the one at level
+func (p *labelParser) parseBinary(level int) (labelExpr, error) {
+	if level == len(labelOperators) {
+		return p.parseUnary()
+	}
+
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := p.peek()
+		if !ok || t.atom || t.text != labelOperators[level] {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = labelBinary{t.text, left, right}
+	}
+}
+
+func (p *labelParser) parseUnary() (labelExpr, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("unexpected end")
+	}
+	p.pos++
+
+	switch {
+	case t.atom:
+		return labelAtom(t.text), nil
+	case t.text == "!":
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return labelNot{e}, nil
+	case t.text == "(":
+		e, err := p.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+		if t, ok := p.peek(); !ok || t.atom || t.text != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return e, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", t.text)
+}
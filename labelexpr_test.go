@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestMatchLabels(t *testing.T) {
+	labels := []string{"windows", "x64", "windows-7"}
+	tests := map[string]bool{
+		"windows":                   true,
+		"linux":                     false,
+		"windows && x64":            true,
+		"windows && !x64":           false,
+		"linux || windows-7":        true,
+		"!linux && (x64 || arm)":    true,
+		"linux -> arm":              true,
+		"windows -> arm":            false,
+		"windows <-> x64":           true,
+		"linux <-> x64":             false,
+		"linux || windows && x64":   true,
+		"(linux || windows) && arm": false,
+		`"windows-7" && !"x86"`:     true,
+	}
+	for expr, expected := range tests {
+		match, err := matchLabels(expr, labels)
+		if err != nil || match != expected {
+			t.Errorf("Fail: expected %q to be %t, got %t, %v", expr, expected, match, err)
+		}
+	}
+}
+
+func TestParseLabelExprInvalid(t *testing.T) {
+	for _, expr := range []string{"", "windows &&", "(linux", "linux)", "&& x64", `"linux`, "linux x64"} {
+		if _, err := parseLabelExpr(expr); err == nil {
+			t.Errorf("Fail: expected %q to be invalid", expr)
+		}
+	}
+}
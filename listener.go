@@ -18,63 +18,127 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// defaultListenerPort is the port the listener binds if listener_port isn't configured
+const defaultListenerPort = "8888"
+
+// Timeouts of the connections of clients, so slow or idle clients can't keep connections open forever
+const (
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = 30 * time.Second
+	idleTimeout       = 2 * time.Minute
 )
 
+// ErrNoTLSCert indicates that client certificates should be verified without serving TLS
+var ErrNoTLSCert = errors.New("Verifying client certificates requires tls_cert_file and tls_key_file")
+
 /*
  * Listener creates a socket to listen on a specified port and holds a reference to the controller to communicate to
  */
 type Listener struct {
 	Controller *Controller
-}
+	// Address is the host and port the listener binds
+	Address string
+	// TLSConfig is nil if the listener serves plain HTTP
+	TLSConfig *tls.Config
+	// Config holds the API tokens clients authenticate with, the API is open if there are none
+	Config *ConfigHolder
 
-/*
- * NewListener creates and returns a new Listener struct
- * TODO: Refactor to check for errors and return if necessary
- */
-func NewListener(port string, controller *Controller) (*Listener, error) {
-	return &Listener{controller}, nil
+	server *http.Server
 }
 
 /*
- * CreateSocket creates a http socket for the listener on the specified port
- * TODO: Refactor and split up in better reusable parts
+ * NewListener creates and returns a new Listener struct for the address and TLS options of the configuration.
+ * The address and TLS options are fixed, the API tokens are taken from the current configuration.
  */
-func (l *Listener) CreateSocket(port string) error {
-	// Inline definition of the handler func for the start command
-	startHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		vmLabel := r.FormValue("label")
-		log.Printf("[LISTENER]: Trying to start a box for label %s.\n", vmLabel)
-		if err := l.Controller.StartVms(vmLabel); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			log.Printf("[LISTENER]: Couldn't start the requested VM. ERROR: %s\n", err)
-			return
+func NewListener(holder *ConfigHolder, controller *Controller) (*Listener, error) {
+	conf := holder.Get()
+	port := conf.ListenerPort
+	if port == "" {
+		port = defaultListenerPort
+	}
+	if err := checkTokens(conf.APITokens); err != nil {
+		return nil, err
+	}
+	l := &Listener{Controller: controller, Address: net.JoinHostPort(conf.ListenerAddress, port), Config: holder}
+
+	if conf.TLSCertFile != "" || conf.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.TLSCertFile, conf.TLSKeyFile)
+		if err != nil {
+			return nil, err
 		}
-		fmt.Fprintf(w, "Successfully stated the box for label %s", vmLabel)
-		log.Printf("[LISTENER]: Successfully started a box for label %s.\n", vmLabel)
-	})
+		l.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
 
-	// Inline definition of the handler func for the destroy command
-	destroyHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		vmLabel := r.FormValue("label")
-		log.Printf("[LISTENER]: Trying to the box for the label %s.\n", vmLabel)
-		if err := l.Controller.DestroyVms(vmLabel); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			log.Printf("[LISTENER]: Couldn't destroy the requested VM. ERROR: %s\n", err)
-			return
+	// Only clients with a certificate signed by the client CA are accepted
+	if conf.TLSClientCAFile != "" {
+		if l.TLSConfig == nil {
+			return nil, ErrNoTLSCert
 		}
-		fmt.Fprintf(w, "Successfully destroyed the box for label %s", vmLabel)
-		log.Printf("[LISTENER]: Successfully destroyed a box for label %s.\n", vmLabel)
-	})
+		pem, err := ioutil.ReadFile(conf.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates found in " + conf.TLSClientCAFile)
+		}
+		l.TLSConfig.ClientCAs = pool
+		l.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
 
-	http.Handle("/start", startHandler)
-	http.Handle("/destroy", destroyHandler)
+	mux := http.NewServeMux()
+	l.registerAPI(mux)
+	mux.Handle("/metrics", promhttp.Handler())
+	l.server = &http.Server{
+		Addr:              l.Address,
+		Handler:           l.authorize(mux),
+		TLSConfig:         l.TLSConfig,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+	return l, nil
+}
 
-	if err := http.ListenAndServe(":8888", nil); err != nil {
-		return err
+/*
+ * CreateSocket creates a http socket for the listener on its address and serves the API until it fails or
+ * the listener is shut down
+ */
+func (l *Listener) CreateSocket() error {
+	if len(l.Config.Get().APITokens) == 0 {
+		log.Printf("[LISTENER]: WARNING: No api_tokens configured, everyone who can reach %s can start and destroy boxes.\n", l.Address)
+	}
+	var err error
+	if l.TLSConfig != nil {
+		log.Printf("[LISTENER]: Serving HTTPS on %s, client certificates are verified: %t.\n", l.Address, l.TLSConfig.ClientCAs != nil)
+		// The certificate is already part of the TLS config
+		err = l.server.ListenAndServeTLS("", "")
+	} else {
+		log.Printf("[LISTENER]: Serving HTTP on %s.\n", l.Address)
+		err = l.server.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		return nil
 	}
+	return err
+}
 
-	return nil
+/*
+ * Shutdown stops accepting connections and waits until the running requests are answered or ctx is done
+ */
+func (l *Listener) Shutdown(ctx context.Context) error {
+	return l.server.Shutdown(ctx)
 }
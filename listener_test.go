@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate and its key to dir and returns their paths
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Fail: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "jam-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Fail: %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Fail: %s", err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestFile(t, certFile, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	writeTestFile(t, keyFile, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})))
+	return certFile, keyFile
+}
+
+func TestNewListenerAddress(t *testing.T) {
+	conf, _ := mockConfig()
+	l, err := NewListener(NewConfigHolder(conf), nil)
+	if err != nil || l.Address != ":8888" || l.TLSConfig != nil {
+		t.Errorf("Fail: expected plain HTTP on :8888, got %+v, %v", l, err)
+	}
+	if l.server.ReadHeaderTimeout == 0 || l.server.IdleTimeout == 0 {
+		t.Errorf("Fail: expected the connections of slow and idle clients to time out, got %+v", l.server)
+	}
+
+	conf.ListenerAddress = "127.0.0.1"
+	conf.ListenerPort = "9000"
+	if l, err := NewListener(NewConfigHolder(conf), nil); err != nil || l.Address != "127.0.0.1:9000" {
+		t.Errorf("Fail: expected 127.0.0.1:9000, got %+v, %v", l, err)
+	}
+}
+
+func TestNewListenerTLS(t *testing.T) {
+	conf, _ := mockConfig()
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir)
+
+	conf.TLSClientCAFile = certFile
+	if _, err := NewListener(NewConfigHolder(conf), nil); err != ErrNoTLSCert {
+		t.Errorf("Fail: expected %s, got %v", ErrNoTLSCert, err)
+	}
+
+	conf.TLSCertFile, conf.TLSKeyFile = certFile, keyFile
+	l, err := NewListener(NewConfigHolder(conf), nil)
+	if err != nil || l.TLSConfig == nil || len(l.TLSConfig.Certificates) != 1 {
+		t.Fatalf("Fail: expected a TLS config with the certificate, got %+v, %v", l, err)
+	}
+	if l.TLSConfig.ClientAuth != tls.RequireAndVerifyClientCert || l.TLSConfig.ClientCAs == nil {
+		t.Errorf("Fail: expected client certificates to be verified")
+	}
+
+	conf.TLSClientCAFile = keyFile
+	if _, err := NewListener(NewConfigHolder(conf), nil); err == nil {
+		t.Errorf("Fail: expected an error for a client CA file without certificates")
+	}
+}
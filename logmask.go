@@ -0,0 +1,68 @@
+/*
+ *
+ * Copyright [2014] [Jörn Domnik]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"io"
+	"net/url"
+	"strings"
+)
+
+// secretMask replaces secrets in the log output
+const secretMask = "********"
+
+// maskSecret returns secretMask for a set secret, so the log shows whether a secret is set but not its value
+func maskSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return secretMask
+}
+
+// secrets returns the secret settings of the configuration, the Jenkins API secret and the API tokens
+func (c *Configuration) secrets() []string {
+	secrets := []string{c.JenkinsApiSecret}
+	for _, t := range c.APITokens {
+		secrets = append(secrets, t.Token)
+	}
+	return secrets
+}
+
+// maskingWriter replaces the secrets of the current configuration with secretMask before the output is written.
+// It's the output of the log, the log writes every message at once, so a secret is never split across writes.
+type maskingWriter struct {
+	out    io.Writer
+	config *ConfigHolder
+}
+
+func (w *maskingWriter) Write(p []byte) (int, error) {
+	s := string(p)
+	for _, secret := range w.config.Get().secrets() {
+		if secret == "" {
+			continue
+		}
+		// Secrets may be logged as part of a URL
+		s = strings.ReplaceAll(s, secret, secretMask)
+		s = strings.ReplaceAll(s, url.QueryEscape(secret), secretMask)
+	}
+	if _, err := io.WriteString(w.out, s); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"testing"
+)
+
+func TestMaskingWriter(t *testing.T) {
+	conf, _ := mockConfig()
+	conf.JenkinsApiSecret = "s3cret+key"
+	conf.APITokens = []confToken{{Name: "ci", Token: "operate", Role: RoleOperator}}
+
+	var out bytes.Buffer
+	logger := log.New(&maskingWriter{&out, NewConfigHolder(conf)}, "", 0)
+	logger.Printf("Get http://jenkins/api?token=s3cret%%2Bkey failed, secret s3cret+key, token operate")
+	if expected := "Get http://jenkins/api?token=******** failed, secret ********, token ********\n"; out.String() != expected {
+		t.Errorf("Fail: expected %q, got %q", expected, out.String())
+	}
+}
@@ -19,23 +19,36 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 /*
  * Definition of configuration constants
  */
 const (
-	defaultConfPath = "/etc/jenkins-agent-manager/config.json"
-	usageConfPath   = "Path to the configuration file. Has to be valid JSON format"
+	defaultConfPath        = "/etc/jenkins-agent-manager/config.json"
+	usageConfPath          = "Path to the configuration file. JSON, YAML (.yaml, .yml) and TOML (.toml) are chosen by the extension"
+	usageDestroyOnShutdown = "Destroy all boxes started by the manager when it shuts down"
+	defaultShutdownTimeout = 2 * time.Minute
 )
 
 /*
  * Definition of configuration variables
  */
-var confPath string
+var (
+	confPath          string
+	destroyOnShutdown bool
+)
 
 /*
  * Initialize main program state
@@ -46,6 +59,7 @@ func init() {
 	 * TODO: Verify that jenkins is installed and running
 	 */
 	flag.StringVar(&confPath, "configurationPath", defaultConfPath, usageConfPath)
+	flag.BoolVar(&destroyOnShutdown, "destroyOnShutdown", false, usageDestroyOnShutdown)
 }
 
 /*
@@ -57,59 +71,258 @@ func main() {
 	 * TODO: Cache all machines from vagrant global-status
 	 * TODO: Create routine that searches for the desired box type, if not existing -> create
 	 * TODO: vagrant up on free boxes, cache internal which boxes are already used
-	 * TODO: reset boxes to a snapshot after it was used
 	 *
 	 */
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validate(os.Args[2:]))
+	}
 	flag.Parse()
 
+	// Signals are handled before any startup work, so an interrupted startup doesn't leave vagrant commands behind
+	interrupted := watchSignals()
+
 	fmt.Println("==== Creating new configuration =====")
 	conf, err := NewConfiguration(confPath)
 	if err != nil {
 		log.Panicf("[MAIN]: ERROR: Couldn't creat configuration.\nError: %s\n", err.Error())
 	}
 	log.Println("Configuration successfully created.")
+	// Every component reads the configuration from the holder, so a reload reaches all of them
+	holder := NewConfigHolder(conf)
+	// Secrets never show up in the log, also not those of a reloaded configuration
+	log.SetOutput(&maskingWriter{os.Stderr, holder})
 	fmt.Println("====  Service started with the following config ====")
 	log.Printf("Jenkins API-Url\t=>\t%+v\n", conf.JenkinsApiUrl)
-	log.Printf("Jenkins API-Secret\t=>\t%+v\n", conf.JenkinsApiSecret)
+	log.Printf("Jenkins API-User\t=>\t%s\n", conf.JenkinsApiUser)
+	log.Printf("Jenkins API-Secret\t=>\t%s\n", maskSecret(conf.JenkinsApiSecret))
 	log.Printf("Listener port\t=>\t%+v\n", conf.ListenerPort)
 	log.Printf("Max. VM count\t=>\t%+v\n", conf.MaxVms)
 	log.Printf("Working directory\t=>\t%+v\n", conf.WorkingDirPath)
 	log.Printf("Boxes\t=>\t%+v\n", conf.Boxes)
-	fmt.Println("====================================================\n")
+	fmt.Print("====================================================\n\n")
 
 	fmt.Printf("==== Trying to fetch jenkins information from %s ====\n", conf.JenkinsApiUrl)
-	jc, err := NewJenkinsConnector(conf.JenkinsApiUrl, conf.JenkinsApiSecret)
+	jc, err := NewJenkinsConnector(conf.JenkinsApiUrl, conf.JenkinsApiUser, conf.JenkinsApiSecret)
 	if err != nil {
 		log.Panicf("[MAIN]: ERROR: Couldn't create a JenkinsConnector instance.\nError: %s\n", err.Error())
 	}
+	// The configuration is valid, so the timeout is a duration
+	if timeout, _ := duration(conf.JenkinsTimeout); timeout > 0 {
+		jc.Timeout = timeout
+	}
 	log.Println("Successfully established connection and collected information.")
-	fmt.Println("====================================================\n")
+	fmt.Print("====================================================\n\n")
 
 	fmt.Println("==== Trying to load vagrant enviroment information ====")
-	vc, err := NewVagrantConnector(conf)
+	store, err := OpenStore(filepath.Join(conf.WorkingDirPath, stateFileName))
+	if err != nil {
+		log.Panicf("[MAIN]: ERROR: Couldn't open the state file in %s.\nError: %s\n", conf.WorkingDirPath, err.Error())
+	}
+	vc, err := NewVagrantConnector(holder, store)
 	if err != nil {
 		log.Panicf("[MAIN]: ERROR: Couldn't create VagrantConnector instance.\nError: %s\n", err.Error())
 	}
 	log.Println("Successfully loaded vagrant enviroment.")
-	fmt.Println("=======================================================\n")
+	prometheus.MustRegister(instanceCollector{vc})
+	fmt.Print("=======================================================\n\n")
 
 	fmt.Println("==== Creating controller instance ====")
-	contr, err := NewController(vc, jc, conf)
+	contr, err := NewController(vc, jc, holder)
 	if err != nil {
 		log.Panicf("[MAIN]: ERROR: Couldn't create Controller instance.\nError: %s\n", err.Error())
 	}
 	log.Println("Successfully create controller instance.")
-	fmt.Println("======================================\n")
+	fmt.Print("======================================\n\n")
+
+	// Closing stop ends the background loops
+	stop := make(chan struct{})
+
+	fmt.Println("==== Reconciling vagrant, jenkins and the state file ====")
+	if err := startReconciler(holder, vc, jc, interrupted, stop); err != nil {
+		log.Panicf("[MAIN]: ERROR: Couldn't create the reconciler.\nError: %s\n", err.Error())
+	}
+	fmt.Println("=========================================================")
+	select {
+	case <-interrupted:
+		log.Println("[MAIN]: Shut down before the startup finished.")
+		return
+	default:
+	}
 
-	if createListener(conf, contr); err != nil {
+	if err := startAutoscaler(conf, contr, stop); err != nil {
+		log.Panicf("[MAIN]: ERROR: Couldn't create the autoscaler.\nError: %s\n", err.Error())
+	}
+
+	if err := startWarmPool(conf, contr, stop); err != nil {
+		log.Panicf("[MAIN]: ERROR: Couldn't create the warm pool.\nError: %s\n", err.Error())
+	}
+
+	if err := startBuildWatcher(conf, contr, stop); err != nil {
+		log.Panicf("[MAIN]: ERROR: Couldn't create the build watcher.\nError: %s\n", err.Error())
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	if err := startReloader(conf, holder, hup, stop); err != nil {
+		log.Panicf("[MAIN]: ERROR: Couldn't create the configuration reloader.\nError: %s\n", err.Error())
+	}
+
+	l, err := NewListener(holder, contr)
+	if err != nil {
 		log.Panicf("[MAIN]: ERROR: Couldn't create HTTP listener.\nError: %s\n", err.Error())
 	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- l.CreateSocket()
+	}()
+
+	select {
+	case <-interrupted:
+	case err := <-serveErr:
+		log.Panicf("[MAIN]: ERROR: The HTTP listener failed.\nError: %s\n", err.Error())
+	}
+	// The shutdown timeout may have been changed by a reload
+	shutdown(holder.Get(), l, contr, stop)
+}
+
+// watchSignals returns a channel that is closed on the first SIGTERM or SIGINT. The second one exits the process
+// right away, without waiting for the drain or the running vagrant commands.
+func watchSignals() <-chan struct{} {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	interrupted := make(chan struct{})
+	go func() {
+		sig := <-signals
+		log.Printf("[MAIN]: Received %s, shutting down. Send it again to exit right away.\n", sig)
+		close(interrupted)
+		sig = <-signals
+		log.Printf("[MAIN]: Received %s again, exiting without waiting for the shutdown.\n", sig)
+		os.Exit(1)
+	}()
+	return interrupted
+}
+
+// validate runs the validate command, it checks the configuration file and returns the exit code
+func validate(args []string) int {
+	var path string
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.StringVar(&path, "configurationPath", defaultConfPath, usageConfPath)
+	fs.Parse(args)
+
+	if _, err := NewConfiguration(path); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	fmt.Printf("The configuration %s is valid.\n", path)
+	return 0
+}
+
+// shutdown stops the background loops, drains the HTTP listener and waits for the running jobs until the
+// shutdown timeout, the vagrant commands still running afterwards are cancelled
+func shutdown(conf *Configuration, l *Listener, c *Controller, stop chan struct{}) {
+	close(stop)
+
+	timeout, err := duration(conf.ShutdownTimeout)
+	if err != nil || timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := l.Shutdown(ctx); err != nil {
+		log.Printf("[MAIN]: ERROR: Couldn't drain the HTTP listener.\nError: %s\n", err.Error())
+	}
+	if err := c.Shutdown(ctx); err != nil {
+		log.Printf("[MAIN]: The running jobs didn't finish within %s, their vagrant commands were cancelled.\n", timeout)
+	}
+
+	if destroyOnShutdown {
+		log.Println("[MAIN]: Destroying all boxes.")
+		if err := c.DestroyAll(os.Stdout); err != nil {
+			log.Printf("[MAIN]: ERROR: Couldn't destroy all boxes.\nError: %s\n", err.Error())
+		}
+	}
+	log.Println("[MAIN]: Shut down.")
 }
 
-func createListener(conf *Configuration, c *Controller) error {
-	l, err := NewListener(conf.ListenerPort, c)
+func startAutoscaler(conf *Configuration, c *Controller, stop <-chan struct{}) error {
+	interval, err := duration(conf.AutoscaleInterval)
+	if err != nil || interval == 0 {
+		return err
+	}
+	idleTimeout, err := duration(conf.IdleTimeout)
+	if err != nil {
+		return err
+	}
+
+	a, err := NewAutoscaler(c, interval, idleTimeout)
+	if err != nil {
+		return err
+	}
+	go a.Run(stop)
+	return nil
+}
+
+// startReconciler runs the startup reconciliation until it succeeded or interrupted is closed, then it starts the
+// periodic reconciliation
+func startReconciler(conf *ConfigHolder, vc *VagrantConnector, jc *JenkinsConnector, interrupted, stop <-chan struct{}) error {
+	interval, err := duration(conf.Get().ReconcileInterval)
+	if err != nil {
+		return err
+	}
+
+	r, err := NewReconciler(vc, jc, conf)
+	if err != nil {
+		return err
+	}
+	// Nothing is started before the leftovers of the last run are cleaned up
+	if !r.ReconcileStartup(interrupted) {
+		return nil
+	}
+	if interval > 0 {
+		go r.Run(interval, stop)
+	}
+	return nil
+}
+
+func startWarmPool(conf *Configuration, c *Controller, stop <-chan struct{}) error {
+	interval, err := duration(conf.PoolInterval)
+	if err != nil {
+		return err
+	}
+
+	p, err := NewWarmPool(c, interval)
+	if err != nil {
+		return err
+	}
+	go p.Run(stop)
+	return nil
+}
+
+func startBuildWatcher(conf *Configuration, c *Controller, stop <-chan struct{}) error {
+	interval, err := duration(conf.BuildWatchInterval)
+	if err != nil {
+		return err
+	}
+
+	w, err := NewBuildWatcher(c, interval)
+	if err != nil {
+		return err
+	}
+	go w.Run(stop)
+	return nil
+}
+
+func startReloader(conf *Configuration, holder *ConfigHolder, hup <-chan os.Signal, stop <-chan struct{}) error {
+	interval, err := duration(conf.ConfigWatchInterval)
+	if err != nil {
+		return err
+	}
+
+	r, err := NewReloader(confPath, holder, interval)
 	if err != nil {
 		return err
 	}
-	return l.CreateSocket(conf.ListenerPort)
+	go r.Run(hup, stop)
+	return nil
 }
@@ -0,0 +1,110 @@
+/*
+ *
+ * Copyright [2014] [Jörn Domnik]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics of the manager, they are served at /metrics in the Prometheus format
+var (
+	vmOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "jam_vm_operations_total",
+		Help: "Starts and destroys of boxes by result.",
+	}, []string{"operation", "result"})
+	vagrantUpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "jam_vagrant_up_duration_seconds",
+		Help:    "Duration of vagrant up by box.",
+		Buckets: prometheus.ExponentialBuckets(15, 2, 8),
+	}, []string{"box"})
+	admissionRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "jam_admission_rejections_total",
+		Help: "Starts refused by the admission check by reason.",
+	}, []string{"reason"})
+	jenkinsRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "jam_jenkins_request_duration_seconds",
+		Help:    "Latency of the requests to the Jenkins API by method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+	jenkinsRequestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "jam_jenkins_request_errors_total",
+		Help: "Failed requests to the Jenkins API by method.",
+	}, []string{"method"})
+	jenkinsFreeMemory = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "jam_jenkins_free_memory_bytes",
+		Help: "Free memory of the host last reported by the Jenkins memory monitor.",
+	})
+	vmsDesc = prometheus.NewDesc("jam_vms", "Boxes on the host by box and state, the ones being created, reset or destroyed included.", []string{"box", "state"}, nil)
+)
+
+func init() {
+	prometheus.MustRegister(vmOperations, vagrantUpDuration, admissionRejections, jenkinsRequestDuration,
+		jenkinsRequestErrors, jenkinsFreeMemory)
+}
+
+// countOperation counts a start or destroy of a box
+func countOperation(operation string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	vmOperations.WithLabelValues(operation, result).Inc()
+}
+
+// countRejection counts a start refused by the admission check, reasons are the codes of the API errors
+func countRejection(err error) {
+	reason := "error"
+	if c, ok := errorCodes[err]; ok {
+		reason = c.code
+	}
+	admissionRejections.WithLabelValues(reason).Inc()
+}
+
+// observeJenkinsRequest records the latency of a request to the Jenkins API started at start
+func observeJenkinsRequest(method string, start time.Time, err error) {
+	jenkinsRequestDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		jenkinsRequestErrors.WithLabelValues(method).Inc()
+	}
+}
+
+// instanceCollector counts the instances of a provisioner whenever the metrics are scraped. They are counted by
+// box and state only, the requested labels are arbitrary expressions of the clients.
+type instanceCollector struct {
+	Provisioner Provisioner
+}
+
+func (c instanceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- vmsDesc
+}
+
+func (c instanceCollector) Collect(ch chan<- prometheus.Metric) {
+	type key struct {
+		box   string
+		state InstanceState
+	}
+	counts := make(map[key]int)
+	for _, inst := range c.Provisioner.ListVms() {
+		counts[key{inst.Box, inst.State}]++
+	}
+	for k, count := range counts {
+		ch <- prometheus.MustNewConstMetric(vmsDesc, prometheus.GaugeValue, float64(count), k.box, string(k.state))
+	}
+}
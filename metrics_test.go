@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	fp := &fakeProvisioner{running: 2, boxMemory: 1024}
+	contr, mj := mockController(t, fp, 4096)
+	defer mj.Close()
+
+	rejected := testutil.ToFloat64(admissionRejections.WithLabelValues("too_many_vms"))
+	contr.CheckAdmission("windows")
+	if count := testutil.ToFloat64(admissionRejections.WithLabelValues("too_many_vms")); count != rejected+1 {
+		t.Errorf("Fail: expected the rejection to be counted, got %f", count-rejected)
+	}
+
+	// The requested labels don't show up in the metrics
+	for _, label := range []string{"windows", "windows && !linux"} {
+		inst, _ := fp.SpinUpNew(label, contr.Config.Get().WorkingDirPath, nil, nil)
+		inst.State = InstanceRunning
+	}
+	inst, _ := fp.SpinUpNew("windows", contr.Config.Get().WorkingDirPath, nil, nil)
+	inst.State = InstanceDestroying
+	expected := `
+# HELP jam_vms Boxes on the host by box and state, the ones being created, reset or destroyed included.
+# TYPE jam_vms gauge
+jam_vms{box="win7-slave",state="destroying"} 1
+jam_vms{box="win7-slave",state="running"} 2
+`
+	if err := testutil.CollectAndCompare(instanceCollector{fp}, strings.NewReader(expected)); err != nil {
+		t.Errorf("Fail: %s", err)
+	}
+}
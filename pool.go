@@ -0,0 +1,108 @@
+/*
+ *
+ * Copyright [2014] [Jörn Domnik]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// defaultPoolInterval is how often the warm pool is checked if pool_interval isn't configured
+const defaultPoolInterval = 30 * time.Second
+
+// WarmPool keeps min_ready booted and idle agents of every box, so builds don't have to wait for a box to boot.
+// An agent that starts a build is claimed and the pool starts a new box to replace it.
+type WarmPool struct {
+	Controller *Controller
+	Interval   time.Duration
+}
+
+// NewWarmPool creates a WarmPool that is refilled every interval
+func NewWarmPool(c *Controller, interval time.Duration) (*WarmPool, error) {
+	if interval == 0 {
+		interval = defaultPoolInterval
+	}
+	return &WarmPool{c, interval}, nil
+}
+
+// Run refills the pool until stop is closed
+func (p *WarmPool) Run(stop <-chan struct{}) {
+	log.Printf("[POOL]: Refilling the warm pool every %s.\n", p.Interval)
+	p.Fill()
+
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			p.Fill()
+		}
+	}
+}
+
+// Fill starts boxes for every box with less than min_ready agents that are booting or idle
+func (p *WarmPool) Fill() {
+	conf := p.Controller.Config.Get()
+	needed := false
+	for _, box := range conf.Boxes {
+		needed = needed || box.MinReady > 0
+	}
+	// No box may need a pool any more after the configuration was reloaded
+	if !needed {
+		return
+	}
+
+	info, err := p.Controller.JenkinsConnector.GetComputerInfo()
+	if err != nil {
+		log.Printf("[POOL]: ERROR: Can't get the Jenkins computers. Error: %s\n", err.Error())
+		return
+	}
+
+	ready := make(map[string]int)
+	for _, inst := range p.Controller.Provisioner.ListVms() {
+		if readyForBuilds(info, inst) {
+			ready[inst.Box]++
+		}
+	}
+
+	for _, box := range conf.Boxes {
+		if box.MinReady < 1 {
+			continue
+		}
+		selector, err := conf.boxSelector(box.Name)
+		if err != nil {
+			log.Printf("[POOL]: ERROR: %s\n", err.Error())
+			continue
+		}
+
+		// Booting boxes are ready already, only the starts without an instance are added
+		missing := box.MinReady - ready[box.Name] - p.Controller.Unrecorded(selector)
+		for i := 0; i < missing; i++ {
+			// The pool counts against the limits like every other start, the queued ones included
+			job, err := p.Controller.EnqueueStart(selector)
+			if err != nil {
+				log.Printf("[POOL]: Can't start a box %s for the warm pool. Error: %s\n", box.Name, err.Error())
+				break
+			}
+			log.Printf("[POOL]: %d of %d agents of box %s are ready, queued job %s to start another one.\n",
+				ready[box.Name]+i, box.MinReady, box.Name, job.ID)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestBoxSelector(t *testing.T) {
+	conf, _ := mockConfig()
+	conf.Boxes = []confBox{
+		{Name: "win10-slave", Labels: []string{"windows", "windows10"}},
+		{Name: "win7-slave", Labels: []string{"windows"}},
+		{Name: "win7-copy", Labels: []string{"windows"}},
+	}
+
+	selector, err := conf.boxSelector("win7-slave")
+	if err != nil {
+		t.Fatalf("Fail: %s", err)
+	}
+	if box, err := conf.matchBox(selector); err != nil || box.Name != "win7-slave" {
+		t.Errorf("Fail: expected %q to select win7-slave, got %+v, %v", selector, box, err)
+	}
+	if _, err := conf.boxSelector("win7-copy"); err == nil {
+		t.Errorf("Fail: expected win7-copy to be unselectable")
+	}
+}
+
+func TestWarmPoolFillBusyOffline(t *testing.T) {
+	fp := &fakeProvisioner{boxMemory: 1024}
+	contr, mj := mockController(t, fp, 4096)
+	defer mj.Close()
+	contr.Config.Get().Boxes[0].MinReady = 1
+	contr.Config.Get().MaxVms = 10
+	contr.StartVms("windows", ioutil.Discard)
+
+	// The build watcher took the busy agent offline until it's reset
+	mj.mu.Lock()
+	mj.builds["win7-slave-1"] = "http://localhost:8080/job/pr/1/"
+	mj.offline["win7-slave-1"] = resetOfflineMessage
+	mj.mu.Unlock()
+
+	p, _ := NewWarmPool(contr, 0)
+	p.Fill()
+	waitForStarts(contr)
+	if count := len(fp.ListVms()); count != 2 {
+		t.Errorf("Fail: expected the pool to replace the busy agent, got %d boxes", count)
+	}
+}
+
+func TestWarmPoolFillBooting(t *testing.T) {
+	fp := &fakeProvisioner{boxMemory: 1024, booting: make(chan struct{})}
+	contr, mj := mockController(t, fp, 8192)
+	defer mj.Close()
+	contr.Config.Get().Boxes[0].MinReady = 1
+	contr.Config.Get().MaxVms = 10
+	defer close(fp.booting)
+
+	p, _ := NewWarmPool(contr, 0)
+	p.Fill()
+	for i := 0; i < 100 && len(fp.ListVms()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The first box of the pool is booting, raising min_ready starts the second one right away
+	contr.Config.Get().Boxes[0].MinReady = 2
+	p.Fill()
+	if pending := contr.Jobs.Pending(JobStart, "", ""); pending != 2 {
+		t.Errorf("Fail: expected a second start next to the booting box, got %d start jobs", pending)
+	}
+}
+
+func TestWarmPoolQueuedStarts(t *testing.T) {
+	fp := &fakeProvisioner{boxMemory: 1024}
+	contr, mj := mockController(t, fp, 2500)
+	defer mj.Close()
+	contr.Config.Get().Boxes[0].MinReady = 4
+	contr.Config.Get().MaxVms = 10
+	// Nothing is started, the queued starts have to count against the memory
+	contr.Jobs = NewJobQueue(1)
+	block := make(chan struct{})
+	contr.Jobs.Submit(JobDestroy, "", "", func(out io.Writer) error {
+		<-block
+		return nil
+	})
+
+	p, _ := NewWarmPool(contr, 0)
+	p.Fill()
+	if queued := contr.Jobs.Pending(JobStart, "", ""); queued != 2 {
+		t.Errorf("Fail: expected 2 queued starts fitting into the memory, got %d", queued)
+	}
+	close(block)
+	waitForStarts(contr)
+}
+
+func TestWarmPoolFill(t *testing.T) {
+	fp := &fakeProvisioner{boxMemory: 1024}
+	contr, mj := mockController(t, fp, 4096)
+	defer mj.Close()
+	contr.Config.Get().Boxes[0].MinReady = 2
+	contr.Config.Get().MaxVms = 10
+
+	p, _ := NewWarmPool(contr, 0)
+	p.Fill()
+	for i := 0; i < 100 && len(fp.ListVms()) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count := len(fp.ListVms()); count != 2 {
+		t.Fatalf("Fail: expected the pool to start 2 boxes, got %d", count)
+	}
+
+	// The agents are idle, so the pool is full
+	p.Fill()
+	time.Sleep(50 * time.Millisecond)
+	if count := len(fp.ListVms()); count != 2 {
+		t.Errorf("Fail: expected the pool to stay at 2 boxes, got %d", count)
+	}
+}
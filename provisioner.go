@@ -0,0 +1,103 @@
+/*
+ *
+ * Copyright [2014] [Jörn Domnik]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"time"
+)
+
+// Instance describes a single machine a Provisioner started for a label
+type Instance struct {
+	ID          string            `json:"id"`
+	Box         string            `json:"box"`
+	Label       string            `json:"label"`
+	Dir         string            `json:"dir"`
+	NodeName    string            `json:"node_name"`
+	Builds      []string          `json:"builds,omitempty"`
+	State       InstanceState     `json:"state"`
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+	Transitions []StateTransition `json:"transitions"`
+}
+
+// setState moves the instance into state and records the transition
+func (inst *Instance) setState(state InstanceState, at time.Time) {
+	inst.State = state
+	inst.UpdatedAt = at
+	inst.Transitions = append(inst.Transitions, StateTransition{state, at})
+}
+
+// copy returns a deep copy of the instance
+func (inst *Instance) copy() *Instance {
+	c := *inst
+	c.Builds = append([]string(nil), inst.Builds...)
+	c.Transitions = append([]StateTransition(nil), inst.Transitions...)
+	return &c
+}
+
+// Agent holds what a machine needs to connect to Jenkins as agent on its own
+type Agent struct {
+	JenkinsURL string
+	Name       string
+	Secret     string
+	WorkDir    string
+}
+
+// RegisterFunc registers the instance as Jenkins agent and returns the agent the machine has to run
+type RegisterFunc func(inst *Instance) (*Agent, error)
+
+// newRandomID generates a short random identifier for instances and jobs
+func newRandomID() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Provisioner is the interface a backend has to implement to be able to start and destroy
+// agent machines for the Controller. VagrantConnector is the default implementation.
+// The output of the commands a backend runs is written to the passed writer.
+type Provisioner interface {
+	// SpinUpNew starts a new instance of the box configured for label inside workingPath. register is called
+	// once the instance is allocated and before its machine boots, so the agent can be handed to the machine.
+	SpinUpNew(label string, workingPath string, register RegisterFunc, out io.Writer) (*Instance, error)
+	// DestroyInstance destroys the instance with the given id and returns it
+	DestroyInstance(id string, out io.Writer) (*Instance, error)
+	// ResetInstance restores the machine of the instance to the state right after its first provisioning
+	// and returns the instance
+	ResetInstance(id string, out io.Writer) (*Instance, error)
+	// RecordBuilds adds the URLs of builds the agent of the instance ran to its record
+	RecordBuilds(id string, urls []string) error
+	// DestroyVms destroys all instances of the box configured for label and returns the destroyed ones
+	DestroyVms(label string, workingDir string, out io.Writer) ([]*Instance, error)
+	// ListVms returns all instances the provisioner started whose machine still exists
+	ListVms() []*Instance
+	// GetVmCount returns the number of instances whose machine exists
+	GetVmCount() int
+	// GetBoxMemory returns the memory in bytes a machine for label needs
+	GetBoxMemory(label string) (int64, error)
+	// Cancel aborts the commands the provisioner is running, the calls running them return an error
+	Cancel()
+}
+
+// Make sure the VagrantConnector satisfies the Provisioner interface
+var _ Provisioner = (*VagrantConnector)(nil)
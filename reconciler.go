@@ -0,0 +1,293 @@
+/*
+ *
+ * Copyright [2014] [Jörn Domnik]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Reconciler compares the vagrant machine index, the Jenkins nodes and the records of the store and fixes
+// the differences left behind by crashes or restarts of the manager:
+//   - vagrant machines in the working directory without a record are adopted if their Jenkins node
+//     exists and destroyed otherwise
+//   - records whose vagrant machine is gone are marked destroyed
+//   - records whose Jenkins node is gone have their machine destroyed
+//   - managed Jenkins nodes without a record are unregistered
+//   - instance directories without a record are removed
+type Reconciler struct {
+	VagrantConnector *VagrantConnector
+	JenkinsConnector *JenkinsConnector
+	Config           *ConfigHolder
+	// LoadIndex loads the vagrant machine index, it's replaced in tests
+	LoadIndex func() (*VagrantIndex, error)
+}
+
+// Delays between the attempts of the startup reconciliation, the delay doubles after every failed attempt
+var (
+	startupRetryDelay    = 5 * time.Second
+	maxStartupRetryDelay = time.Minute
+)
+
+// NewReconciler creates a Reconciler for the instances of the VagrantConnector
+func NewReconciler(vc *VagrantConnector, jc *JenkinsConnector, conf *ConfigHolder) (*Reconciler, error) {
+	return &Reconciler{vc, jc, conf, loadVagrantIndex}, nil
+}
+
+// Run reconciles every interval until stop is closed
+func (r *Reconciler) Run(interval time.Duration, stop <-chan struct{}) {
+	log.Printf("[RECONCILER]: Reconciling every %s.\n", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := r.Reconcile(false); err != nil {
+				log.Printf("[RECONCILER]: ERROR: Reconciliation failed. Error: %s\n", err.Error())
+			}
+		}
+	}
+}
+
+// ReconcileStartup runs the startup reconciliation until it succeeds, e.g. once Jenkins is reachable. Later runs
+// leave records that aren't running alone, so records left creating or destroying by a crash would count against
+// max_vm_count forever otherwise. It returns false if stop was closed before.
+func (r *Reconciler) ReconcileStartup(stop <-chan struct{}) bool {
+	delay := startupRetryDelay
+	for {
+		err := r.Reconcile(true)
+		if err == nil {
+			return true
+		}
+		log.Printf("[RECONCILER]: ERROR: Reconciliation on startup failed, retrying in %s. Error: %s\n", delay, err.Error())
+		select {
+		case <-stop:
+			return false
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxStartupRetryDelay {
+			delay = maxStartupRetryDelay
+		}
+	}
+}
+
+// Reconcile runs one reconciliation. On startup no start or destroy can be in progress, so instances
+// still creating or destroying are stale and get reconciled as well, later they are left alone.
+func (r *Reconciler) Reconcile(startup bool) error {
+	index, err := r.LoadIndex()
+	if err == ErrNoVagrant {
+		index = &VagrantIndex{Machines: make(map[string]Machine)}
+	} else if err != nil {
+		return err
+	}
+	info, err := r.JenkinsConnector.GetComputerInfo()
+	if err != nil {
+		return err
+	}
+	store := r.VagrantConnector.Store
+
+	records := make(map[string]*Instance)
+	for _, inst := range store.Active() {
+		records[filepath.Clean(inst.Dir)] = inst
+	}
+
+	// Vagrant machines living in instance directories, keyed by directory. The machines of instances whose box
+	// was removed from the configuration are kept, their box is no longer configured but they still run.
+	machines := make(map[string]Machine)
+	for _, m := range index.Machines {
+		dir := filepath.Clean(m.VagrantfilePath)
+		if _, ok := records[dir]; ok || r.instanceDir(dir) {
+			machines[dir] = m
+		}
+	}
+
+	// Machines without a record
+	for dir, m := range machines {
+		if _, ok := records[dir]; ok {
+			continue
+		}
+		name := filepath.Base(dir)
+		if _, ok := info.computer(name); ok && m.State == "running" {
+			inst, err := r.adopt(dir)
+			if err != nil {
+				log.Printf("[RECONCILER]: ERROR: Couldn't adopt the machine at %s. Error: %s\n", dir, err.Error())
+				continue
+			}
+			records[dir] = inst
+			log.Printf("[RECONCILER]: Adopted the running machine at %s as instance %s.\n", dir, inst.ID)
+			continue
+		}
+		if err := r.destroyDir(dir); err != nil {
+			continue
+		}
+		delete(machines, dir)
+		log.Printf("[RECONCILER]: Destroyed the machine at %s, it had no record and no Jenkins node.\n", dir)
+	}
+
+	// Records without a machine or without a Jenkins node
+	unregistered := make(map[string]bool)
+	for dir, inst := range records {
+		if !startup && inst.State != InstanceRunning {
+			continue
+		}
+
+		if m, ok := machines[dir]; !ok || m.State != "running" || inst.State == InstanceDestroying {
+			if ok {
+				if err := r.destroyDir(dir); err != nil {
+					continue
+				}
+			}
+			r.markDestroyed(inst, info)
+			unregistered[inst.NodeName] = true
+			delete(records, dir)
+			log.Printf("[RECONCILER]: Marked instance %s as destroyed, its machine is gone.\n", inst.ID)
+			continue
+		}
+
+		if _, ok := info.computer(inst.NodeName); !ok {
+			var out bytes.Buffer
+			if _, err := r.VagrantConnector.DestroyInstance(inst.ID, &out); err != nil {
+				log.Printf("[RECONCILER]: ERROR: Couldn't destroy instance %s. Error: %s\n%s\n", inst.ID, err.Error(), out.String())
+				continue
+			}
+			delete(records, dir)
+			log.Printf("[RECONCILER]: Destroyed instance %s, its Jenkins node %s is gone.\n", inst.ID, inst.NodeName)
+			continue
+		}
+
+		if inst.State != InstanceRunning {
+			store.SetState(inst.ID, InstanceRunning)
+			log.Printf("[RECONCILER]: Instance %s was left %s, its machine and Jenkins node are up. Marked it running.\n", inst.ID, inst.State)
+		}
+	}
+
+	// Managed Jenkins nodes without a record
+	nodes := make(map[string]bool)
+	for _, inst := range store.Active() {
+		nodes[inst.NodeName] = true
+	}
+	for _, c := range info.Computers {
+		if !c.managed() || nodes[c.DisplayName] || unregistered[c.DisplayName] {
+			continue
+		}
+		if err := r.JenkinsConnector.DeleteNode(c.DisplayName); err != nil {
+			log.Printf("[RECONCILER]: ERROR: Couldn't unregister the Jenkins node %s. Error: %s\n", c.DisplayName, err.Error())
+			continue
+		}
+		log.Printf("[RECONCILER]: Unregistered the Jenkins node %s, it belongs to no instance.\n", c.DisplayName)
+	}
+
+	r.removeLeftovers(store)
+	return nil
+}
+
+// adopt records the machine at dir as running instance
+func (r *Reconciler) adopt(dir string) (*Instance, error) {
+	name := filepath.Base(dir)
+	i := strings.LastIndex(name, "-")
+	id := name[i+1:]
+
+	store := r.VagrantConnector.Store
+	if _, err := store.Get(id); err == nil {
+		if err := store.SetState(id, InstanceRunning); err != nil {
+			return nil, err
+		}
+		return store.Get(id)
+	}
+	inst := &Instance{ID: id, Box: name[:i], Dir: dir, NodeName: name, CreatedAt: time.Now()}
+	if err := store.Put(inst, InstanceRunning); err != nil {
+		return nil, err
+	}
+	return store.Get(id)
+}
+
+// markDestroyed records that the machine of the instance is gone and unregisters its Jenkins node
+func (r *Reconciler) markDestroyed(inst *Instance, info *ComputerInfo) {
+	r.VagrantConnector.Store.SetState(inst.ID, InstanceDestroyed)
+	if _, ok := info.computer(inst.NodeName); ok {
+		if err := r.JenkinsConnector.DeleteNode(inst.NodeName); err != nil {
+			log.Printf("[RECONCILER]: ERROR: Couldn't unregister the Jenkins node %s. Error: %s\n", inst.NodeName, err.Error())
+		}
+	}
+	if err := os.RemoveAll(inst.Dir); err != nil {
+		log.Printf("[RECONCILER]: ERROR: Couldn't remove the directory %s. Error: %s\n", inst.Dir, err.Error())
+	}
+}
+
+// destroyDir destroys the vagrant machine at dir and removes the directory
+func (r *Reconciler) destroyDir(dir string) error {
+	var out bytes.Buffer
+	if err := destroyBox(r.VagrantConnector.commandContext(), dir, &out); err != nil {
+		log.Printf("[RECONCILER]: ERROR: Couldn't destroy the machine at %s. Error: %s\n%s\n", dir, err.Error(), out.String())
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// removeLeftovers removes the instance directories in the working directory that belong to no active instance
+func (r *Reconciler) removeLeftovers(store *Store) {
+	workingDir := r.Config.Get().WorkingDirPath
+	entries, err := ioutil.ReadDir(workingDir)
+	if err != nil {
+		log.Printf("[RECONCILER]: ERROR: Couldn't read the working directory. Error: %s\n", err.Error())
+		return
+	}
+
+	dirs := make(map[string]bool)
+	for _, inst := range store.Active() {
+		dirs[filepath.Clean(inst.Dir)] = true
+	}
+	for _, e := range entries {
+		dir := filepath.Join(workingDir, e.Name())
+		if !e.IsDir() || dirs[dir] || !r.instanceDir(dir) {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("[RECONCILER]: ERROR: Couldn't remove the leftover directory %s. Error: %s\n", dir, err.Error())
+			continue
+		}
+		log.Printf("[RECONCILER]: Removed the leftover directory %s.\n", dir)
+	}
+}
+
+// instanceIDPattern matches the instance id suffix of instance directories
+var instanceIDPattern = regexp.MustCompile(`^-[0-9a-f]{8}$`)
+
+// instanceDir reports whether dir is an instance directory of a configured box in the working directory
+func (r *Reconciler) instanceDir(dir string) bool {
+	conf := r.Config.Get()
+	if filepath.Dir(dir) != filepath.Clean(conf.WorkingDirPath) {
+		return false
+	}
+	name := filepath.Base(dir)
+	for _, box := range conf.Boxes {
+		if strings.HasPrefix(name, box.Name) && instanceIDPattern.MatchString(name[len(box.Name):]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReconcile(t *testing.T) {
+	fp := &fakeProvisioner{}
+	contr, mj := mockController(t, fp, 4096)
+	defer mj.Close()
+	conf := contr.Config.Get()
+	vc := mockVagrantConnector(conf)
+
+	workDir := conf.WorkingDirPath
+	adoptDir := filepath.Join(workDir, "win7-slave-0000000a")
+	goneDir := filepath.Join(workDir, "win7-slave-0000000b")
+	leftoverDir := filepath.Join(workDir, "win7-slave-0000000c")
+	otherDir := filepath.Join(workDir, "something-else")
+	for _, dir := range []string{adoptDir, leftoverDir, otherDir} {
+		os.MkdirAll(dir, 0755)
+	}
+
+	// A record whose machine is gone, a running machine without a record and a node without an instance
+	vc.Store.Put(&Instance{ID: "0000000b", Box: "win7-slave", Dir: goneDir, NodeName: "win7-slave-0000000b", CreatedAt: time.Now()}, InstanceRunning)
+	mj.nodes = []string{"win7-slave-0000000a", "win7-slave-0000000b", "win7-slave-0000000d"}
+
+	r, _ := NewReconciler(vc, contr.JenkinsConnector, contr.Config)
+	r.LoadIndex = func() (*VagrantIndex, error) {
+		return &VagrantIndex{1, map[string]Machine{"abc": {Name: "default", State: "running", VagrantfilePath: adoptDir}}}, nil
+	}
+	if err := r.Reconcile(true); err != nil {
+		t.Fatalf("Fail: %s", err)
+	}
+
+	if inst, err := vc.Store.Get("0000000a"); err != nil || inst.State != InstanceRunning || inst.Box != "win7-slave" {
+		t.Errorf("Fail: expected the running machine to be adopted, got %+v, %v", inst, err)
+	}
+	if inst, err := vc.Store.Get("0000000b"); err != nil || inst.State != InstanceDestroyed {
+		t.Errorf("Fail: expected the instance without machine to be destroyed, got %+v, %v", inst, err)
+	}
+	if len(mj.deleted) != 2 || mj.deleted[0] != "win7-slave-0000000b" || mj.deleted[1] != "win7-slave-0000000d" {
+		t.Errorf("Fail: expected the nodes without machine to be unregistered, got %v", mj.deleted)
+	}
+	if _, err := os.Stat(leftoverDir); !os.IsNotExist(err) {
+		t.Errorf("Fail: expected the leftover directory to be removed")
+	}
+	for _, dir := range []string{adoptDir, otherDir} {
+		if _, err := os.Stat(dir); err != nil {
+			t.Errorf("Fail: expected %s to be kept, got %s", dir, err)
+		}
+	}
+}
+
+func TestReconcileStartupRetry(t *testing.T) {
+	fp := &fakeProvisioner{}
+	contr, mj := mockController(t, fp, 4096)
+	defer mj.Close()
+	conf := contr.Config.Get()
+	vc := mockVagrantConnector(conf)
+	defer func(delay time.Duration) { startupRetryDelay = delay }(startupRetryDelay)
+	startupRetryDelay = time.Millisecond
+
+	// A crash left a record creating, its machine never booted
+	stale := filepath.Join(conf.WorkingDirPath, "win7-slave-0000000e")
+	vc.Store.Put(&Instance{ID: "0000000e", Box: "win7-slave", Dir: stale, NodeName: "win7-slave-0000000e", CreatedAt: time.Now()}, InstanceCreating)
+
+	attempts := 0
+	r, _ := NewReconciler(vc, contr.JenkinsConnector, contr.Config)
+	r.LoadIndex = func() (*VagrantIndex, error) {
+		if attempts++; attempts < 3 {
+			return nil, errors.New("vagrant is busy")
+		}
+		return &VagrantIndex{1, map[string]Machine{}}, nil
+	}
+	if !r.ReconcileStartup(make(chan struct{})) || attempts != 3 {
+		t.Errorf("Fail: expected the reconciliation to succeed with the third attempt, got %d attempts", attempts)
+	}
+	if inst, err := vc.Store.Get("0000000e"); err != nil || inst.State != InstanceDestroyed {
+		t.Errorf("Fail: expected the stale record to be marked destroyed, got %+v, %v", inst, err)
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	r.LoadIndex = func() (*VagrantIndex, error) { return nil, errors.New("vagrant is busy") }
+	if r.ReconcileStartup(stop) {
+		t.Errorf("Fail: expected the reconciliation to give up once stopped")
+	}
+}
@@ -0,0 +1,141 @@
+/*
+ *
+ * Copyright [2014] [Jörn Domnik]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// defaultConfigWatchInterval is how often the configuration file is checked for changes if config_watch_interval
+// isn't configured
+const defaultConfigWatchInterval = 10 * time.Second
+
+// startupSettings are only read on startup, a reload keeps their current values until the manager is restarted
+var startupSettings = map[string]bool{
+	"jenkins_api_url":       true,
+	"jenkins_api_user":      true,
+	"jenkins_api_secret":    true,
+	"jenkins_timeout":       true,
+	"listener_port":         true,
+	"listener_address":      true,
+	"tls_cert_file":         true,
+	"tls_key_file":          true,
+	"tls_client_ca_file":    true,
+	"working_dir_path":      true,
+	"job_workers":           true,
+	"autoscale_interval":    true,
+	"idle_timeout":          true,
+	"reconcile_interval":    true,
+	"host_resource_source":  true,
+	"jenkins_monitor_node":  true,
+	"pool_interval":         true,
+	"build_watch_interval":  true,
+	"config_watch_interval": true,
+}
+
+// Reloader reloads the configuration when the manager receives SIGHUP or the configuration file changes. A new
+// configuration is validated before it replaces the current one, an invalid one is rejected and the current one
+// stays in place. The running instances are kept, even if their box was removed.
+type Reloader struct {
+	Path     string
+	Config   *ConfigHolder
+	Interval time.Duration
+
+	modTime time.Time
+	size    int64
+}
+
+// NewReloader creates a Reloader that checks the configuration file at path for changes every interval
+func NewReloader(path string, conf *ConfigHolder, interval time.Duration) (*Reloader, error) {
+	if interval == 0 {
+		interval = defaultConfigWatchInterval
+	}
+	r := &Reloader{Path: path, Config: conf, Interval: interval}
+	// The file was just loaded, so its current state isn't a change
+	r.changed()
+	return r, nil
+}
+
+// Run reloads the configuration on every signal from hup and every change of the file until stop is closed
+func (r *Reloader) Run(hup <-chan os.Signal, stop <-chan struct{}) {
+	log.Printf("[RELOAD]: Checking %s for changes every %s.\n", r.Path, r.Interval)
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case sig := <-hup:
+			log.Printf("[RELOAD]: Received %s, reloading the configuration.\n", sig)
+			r.changed()
+			r.Reload()
+		case <-ticker.C:
+			if r.changed() {
+				log.Printf("[RELOAD]: %s changed, reloading the configuration.\n", r.Path)
+				r.Reload()
+			}
+		}
+	}
+}
+
+// changed reports whether the modification time or the size of the file changed since the last call
+func (r *Reloader) changed() bool {
+	info, err := os.Stat(r.Path)
+	if err != nil {
+		// The file may be replaced right now, it's checked again with the next tick
+		return false
+	}
+	changed := !info.ModTime().Equal(r.modTime) || info.Size() != r.size
+	r.modTime, r.size = info.ModTime(), info.Size()
+	return changed
+}
+
+// Reload loads and validates the configuration file and replaces the current configuration with it
+func (r *Reloader) Reload() error {
+	conf, err := NewConfiguration(r.Path)
+	if err != nil {
+		log.Printf("[RELOAD]: ERROR: Rejected the new configuration, the current one stays in place.\nError: %s\n", err.Error())
+		return err
+	}
+	keepStartupSettings(r.Config.Get(), conf)
+	r.Config.Set(conf)
+	log.Printf("[RELOAD]: Reloaded the configuration with %d boxes and at most %d VMs.\n", len(conf.Boxes), conf.MaxVms)
+	return nil
+}
+
+// keepStartupSettings copies the startup settings of old to conf and logs a warning for every changed one
+func keepStartupSettings(old *Configuration, conf *Configuration) {
+	ov, nv := reflect.ValueOf(old).Elem(), reflect.ValueOf(conf).Elem()
+	t := ov.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if !startupSettings[name] {
+			continue
+		}
+		if !reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			log.Printf("[RELOAD]: WARNING: %s changed, the change takes effect after a restart.\n", name)
+			nv.Field(i).Set(ov.Field(i))
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeTestFile(t, path, `{"jenkins_api_url":"http://localhost:8080","max_vm_count":2,"working_dir_path":"/tmp",
+		"boxes":[{"name":"linux","labels":["linux"],"memory":"1GB"}]}`)
+	conf, err := NewConfiguration(path)
+	if err != nil {
+		t.Fatalf("Fail: %s", err)
+	}
+	holder := NewConfigHolder(conf)
+	r, _ := NewReloader(path, holder, 0)
+	if r.changed() {
+		t.Errorf("Fail: expected the loaded file to be unchanged")
+	}
+
+	writeTestFile(t, path, `{"jenkins_api_url":"http://localhost:8080","max_vm_count":4,"working_dir_path":"/var/tmp",
+		"boxes":[{"name":"linux","labels":["linux"],"memory":"1GB"},{"name":"win","labels":["windows"],"memory":"4GB"}]}`)
+	// The modification time may not have changed on file systems with a coarse resolution
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Minute))
+	if !r.changed() {
+		t.Errorf("Fail: expected the written file to be changed")
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Fail: %s", err)
+	}
+	if c := holder.Get(); c.MaxVms != 4 || len(c.Boxes) != 2 || c.WorkingDirPath != "/tmp" {
+		t.Errorf("Fail: expected 4 VMs, 2 boxes and the old working directory, got %d, %d, %s", c.MaxVms, len(c.Boxes), c.WorkingDirPath)
+	}
+	if conf.MaxVms != 2 {
+		t.Errorf("Fail: expected the old configuration to be unchanged, got %d VMs", conf.MaxVms)
+	}
+
+	writeTestFile(t, path, `{"jenkins_api_url":"http://localhost:8080","max_vm_count":0,"working_dir_path":"/tmp"}`)
+	if err := r.Reload(); err == nil {
+		t.Errorf("Fail: expected an invalid configuration to be rejected")
+	}
+	if holder.Get().MaxVms != 4 {
+		t.Errorf("Fail: expected the current configuration to stay in place, got %d VMs", holder.Get().MaxVms)
+	}
+}
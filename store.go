@@ -0,0 +1,235 @@
+/*
+ *
+ * Copyright [2014] [Jörn Domnik]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// stateFileName is the name of the file in the working directory the Store persists the instances to
+const stateFileName = "jam-state.json"
+
+// The records of destroyed and failed instances are pruned after this period
+const recordRetention = 30 * 24 * time.Hour
+
+// InstanceState is the lifecycle state of a managed instance
+type InstanceState string
+
+const (
+	InstanceCreating   InstanceState = "creating"
+	InstanceRunning    InstanceState = "running"
+	InstanceResetting  InstanceState = "resetting"
+	InstanceDestroying InstanceState = "destroying"
+	InstanceDestroyed  InstanceState = "destroyed"
+	InstanceFailed     InstanceState = "failed"
+)
+
+// active reports whether an instance in this state has a machine that occupies the host
+func (s InstanceState) active() bool {
+	return s == InstanceCreating || s == InstanceRunning || s == InstanceResetting || s == InstanceDestroying
+}
+
+// StateTransition records when an instance entered a state
+type StateTransition struct {
+	State InstanceState `json:"state"`
+	At    time.Time     `json:"at"`
+}
+
+// storeFile is the format of the state file
+type storeFile struct {
+	Version   int                  `json:"version"`
+	Instances map[string]*Instance `json:"instances"`
+}
+
+// Store keeps the records of all instances the manager started and writes them to a JSON file after every
+// change, so they survive restarts of the manager. Destroyed instances are kept for auditing until recordRetention
+// passed.
+type Store struct {
+	path      string
+	mu        sync.Mutex
+	instances map[string]*Instance
+}
+
+// OpenStore loads the store from the file at path, the file is created with the first change if it doesn't exist
+func OpenStore(path string) (*Store, error) {
+	s := NewMemoryStore()
+	s.path = path
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Printf("[STORE]: No state file found at %s, starting with an empty store.\n", path)
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var sf storeFile
+	if err := json.Unmarshal(file, &sf); err != nil {
+		return nil, err
+	}
+	if sf.Instances != nil {
+		s.instances = sf.Instances
+	}
+	log.Printf("[STORE]: Loaded %d instance records from %s.\n", len(s.instances), path)
+	return s, nil
+}
+
+// NewMemoryStore creates a store that isn't persisted
+func NewMemoryStore() *Store {
+	return &Store{instances: make(map[string]*Instance)}
+}
+
+// Put adds the instance to the store in the given state. It returns ErrInstanceExists if the id is taken, the
+// existing record is never overwritten. The records of instances gone for longer than recordRetention are pruned.
+func (s *Store) Put(inst *Instance, state InstanceState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.instances[inst.ID]; ok {
+		return ErrInstanceExists
+	}
+	now := time.Now()
+	s.prune(now)
+	c := *inst
+	c.Transitions = nil
+	c.setState(state, now)
+	s.instances[c.ID] = &c
+	return s.save()
+}
+
+// prune removes the records of the instances that have been destroyed or failed for longer than recordRetention,
+// s.mu has to be held by the caller
+func (s *Store) prune(now time.Time) {
+	for id, inst := range s.instances {
+		if !inst.State.active() && now.Sub(inst.UpdatedAt) > recordRetention {
+			delete(s.instances, id)
+		}
+	}
+}
+
+// SetState records the transition of the instance into state
+func (s *Store) SetState(id string, state InstanceState) error {
+	return s.Update(id, func(inst *Instance) {
+		inst.setState(state, time.Now())
+	})
+}
+
+// Update applies fn to the record of the instance and saves the store
+func (s *Store) Update(id string, fn func(inst *Instance)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inst, ok := s.instances[id]
+	if !ok {
+		return ErrInstanceNotFound
+	}
+	fn(inst)
+	return s.save()
+}
+
+// Get returns a copy of the record of the instance
+func (s *Store) Get(id string) (*Instance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inst, ok := s.instances[id]
+	if !ok {
+		return nil, ErrInstanceNotFound
+	}
+	return inst.copy(), nil
+}
+
+// List returns copies of all records, including the ones of destroyed instances, ordered by creation time
+func (s *Store) List() []*Instance {
+	return s.filter(func(inst *Instance) bool { return true })
+}
+
+// Active returns copies of the records of the instances whose machine exists, ordered by creation time
+func (s *Store) Active() []*Instance {
+	return s.filter(func(inst *Instance) bool { return inst.State.active() })
+}
+
+// CountActive returns the number of instances whose machine exists
+func (s *Store) CountActive() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var count int
+	for _, inst := range s.instances {
+		if inst.State.active() {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *Store) filter(keep func(inst *Instance) bool) []*Instance {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]*Instance, 0, len(s.instances))
+	for _, inst := range s.instances {
+		if keep(inst) {
+			list = append(list, inst.copy())
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// save writes the store to a temporary file and moves it over the state file, s.mu has to be held by the caller
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(storeFile{1, s.instances}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		log.Printf("[STORE]: ERROR: Couldn't write the state file %s. Error: %s\n", s.path, err.Error())
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), stateFileName)
+	store, err := OpenStore(path)
+	if err != nil {
+		t.Fatalf("Fail: %s", err)
+	}
+
+	inst := &Instance{ID: "1a2b3c4d", Box: "win7-slave", Label: "windows", NodeName: "win7-slave-1a2b3c4d", CreatedAt: time.Now()}
+	store.Put(inst, InstanceCreating)
+	store.SetState(inst.ID, InstanceRunning)
+	store.Put(&Instance{ID: "5e6f7a8b", Box: "win7-slave", CreatedAt: time.Now()}, InstanceCreating)
+	store.SetState("5e6f7a8b", InstanceFailed)
+
+	reopened, err := OpenStore(path)
+	if err != nil {
+		t.Fatalf("Fail: %s", err)
+	}
+	if count := reopened.CountActive(); count != 1 {
+		t.Errorf("Fail: expected one active instance, got %d", count)
+	}
+	if all := reopened.List(); len(all) != 2 {
+		t.Errorf("Fail: expected two records, got %d", len(all))
+	}
+
+	got, err := reopened.Get(inst.ID)
+	if err != nil || got.State != InstanceRunning || got.NodeName != inst.NodeName || len(got.Transitions) != 2 {
+		t.Errorf("Fail: expected the running instance with two transitions, got %+v, %v", got, err)
+	}
+}
+
+func TestStorePutCollisionAndPrune(t *testing.T) {
+	store := NewMemoryStore()
+	store.Put(&Instance{ID: "1a2b3c4d", Box: "win7-slave", Builds: []string{"http://localhost:8080/job/pr/1/"}}, InstanceCreating)
+	store.SetState("1a2b3c4d", InstanceDestroyed)
+
+	// A new instance with a taken id doesn't overwrite the retained record
+	if err := store.Put(&Instance{ID: "1a2b3c4d", Box: "win7-slave"}, InstanceCreating); err != ErrInstanceExists {
+		t.Errorf("Fail: expected %s, got %v", ErrInstanceExists, err)
+	}
+	if got, _ := store.Get("1a2b3c4d"); got.State != InstanceDestroyed || len(got.Builds) != 1 {
+		t.Errorf("Fail: expected the destroyed record to be kept, got %+v", got)
+	}
+
+	// Records gone for longer than the retention are pruned with the next new instance, active ones are kept
+	store.Put(&Instance{ID: "5e6f7a8b", Box: "win7-slave"}, InstanceRunning)
+	store.Update("1a2b3c4d", func(inst *Instance) { inst.UpdatedAt = time.Now().Add(-recordRetention - time.Hour) })
+	store.Update("5e6f7a8b", func(inst *Instance) { inst.UpdatedAt = time.Now().Add(-recordRetention - time.Hour) })
+	store.Put(&Instance{ID: "9c0d1e2f", Box: "win7-slave"}, InstanceCreating)
+	if all := store.List(); len(all) != 2 {
+		t.Errorf("Fail: expected the old destroyed record to be pruned, got %d records", len(all))
+	}
+	if _, err := store.Get("1a2b3c4d"); err != ErrInstanceNotFound {
+		t.Errorf("Fail: expected the old record to be gone, got %v", err)
+	}
+}
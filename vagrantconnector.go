@@ -20,16 +20,21 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/docker/docker/pkg/units"
 )
@@ -41,8 +46,19 @@ var (
 	ErrNoMachines = errors.New("No machines found")
 	// ErrorBoxNotFound indicats that no box was configured for the defined label
 	ErrBoxNotFound = errors.New("No boxes for the specified lable found")
+	// ErrInstanceNotFound indicates that no instance with the requested id is managed
+	ErrInstanceNotFound = errors.New("No instance with the specified id found")
+	// ErrInstanceExists indicates that a record with the id of a new instance exists already
+	ErrInstanceExists = errors.New("An instance with the specified id exists already")
+	// ErrInstanceNotRunning indicates that the instance is booting, being reset or destroyed
+	ErrInstanceNotRunning = errors.New("The instance is not running")
+	// ErrNoSnapshot indicates that the box of the instance doesn't keep a clean snapshot
+	ErrNoSnapshot = errors.New("The box of the instance has no snapshot")
 )
 
+// cleanSnapshot is the name of the snapshot taken after the first provisioning of boxes in snapshot mode
+const cleanSnapshot = "jam-clean"
+
 type vagrantBox struct {
 	Name     string `json:"name"`
 	Provider string `json:"provider"`
@@ -72,12 +88,22 @@ type VagrantIndex struct {
 type VagrantConnector struct {
 	Index  *VagrantIndex
 	Boxes  *[]Box
-	Config *Configuration
+	Config *ConfigHolder
+	// Store holds the records of every vagrant environment started by this connector
+	Store *Store
+
+	// ctx is the context the vagrant commands run with, it's replaced when the commands are cancelled
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
+// vagrantKillDelay is how long a cancelled vagrant command may take to clean up before it's killed
+const vagrantKillDelay = 30 * time.Second
+
 var vagrantIndexPath string
 
-func NewVagrantConnector(conf *Configuration) (*VagrantConnector, error) {
+func NewVagrantConnector(conf *ConfigHolder, store *Store) (*VagrantConnector, error) {
 	// Parse the vagrant machines index and save them
 	vIndex, err := loadVagrantIndex()
 	if err != nil {
@@ -94,7 +120,7 @@ func NewVagrantConnector(conf *Configuration) (*VagrantConnector, error) {
 	}
 
 	// Create a new vagrant connector and return it
-	return &VagrantConnector{vIndex, vBoxes, conf}, nil
+	return &VagrantConnector{Index: vIndex, Boxes: vBoxes, Config: conf, Store: store}, nil
 }
 
 type Box struct {
@@ -222,157 +248,275 @@ func (vc *VagrantConnector) Print() {
 		fmt.Printf("vagrantfile path: %s\n", v.VagrantfilePath)
 		fmt.Printf("updated at: %s\n", v.UpdatedAt)
 		fmt.Printf("extra data: ")
-		fmt.Println(v.ExtraData, "\n")
+		fmt.Printf("%v\n\n", v.ExtraData)
 	}
 }
 
+// ListVms returns all instances started by the connector whose machine still exists
+func (vc *VagrantConnector) ListVms() []*Instance {
+	return vc.Store.Active()
+}
+
+// GetVmCount returns the number of instances started by the connector, including the ones still booting
 func (vc *VagrantConnector) GetVmCount() int {
-	var runningCount int
-	for _, machine := range vc.Index.Machines {
-		if machine.State == "running" {
-			runningCount++
-		}
-	}
-	return runningCount
+	return vc.Store.CountActive()
 }
 
-func spinUpExec(box string, workingDir string) {
-	//	defer waitGrp.Done()
-	comm := exec.Command("vagrant", "up")
-	comm.Dir = workingDir
-	var errOut bytes.Buffer
-	var stdOut bytes.Buffer
-	comm.Stderr = &errOut
-	comm.Stdout = &stdOut
-	if err := comm.Start(); err != nil {
-		log.Fatalf("[VC] ERROR: While starting command %+v\nERROR: %s\n%s\n", comm, err.Error(), errOut)
-	}
-	log.Printf("\n%s\n", stdOut)
-	if err := comm.Wait(); err != nil {
-		log.Fatalf("[VC] ERROR: While running command %+v\nERROR: %s\n%s\n", comm, err.Error(), errOut)
+// commandContext returns the context the vagrant commands are started with
+func (vc *VagrantConnector) commandContext() context.Context {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	if vc.ctx == nil {
+		vc.ctx, vc.cancel = context.WithCancel(context.Background())
 	}
+	return vc.ctx
 }
 
-func vagrantfileExists(path string) bool {
-	entries, err := ioutil.ReadDir(path)
-	if err != nil {
-		log.Fatalf("[VS] ERROR: reading directory\nERROR: %s\n", err.Error())
-		return false
+// Cancel interrupts the running vagrant commands, commands started afterwards aren't affected
+func (vc *VagrantConnector) Cancel() {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	if vc.cancel != nil {
+		vc.cancel()
+		vc.ctx, vc.cancel = nil, nil
 	}
+}
 
-	for _, e := range entries {
-		if !e.IsDir() {
-			if e.Name() == "Vagrantfile" {
-				return true
-			}
+// spinUpExec runs vagrant up in workingDir and writes the command output to out
+func spinUpExec(ctx context.Context, box string, workingDir string, out io.Writer) error {
+	return vagrantExec(ctx, workingDir, out, "up")
+}
+
+// vagrantExec runs vagrant with args in the vagrant enviroment at dir and writes the command output to out.
+// If ctx is done, vagrant is interrupted so it can clean up and killed if it didn't exit after vagrantKillDelay.
+func vagrantExec(ctx context.Context, dir string, out io.Writer, args ...string) error {
+	comm := exec.CommandContext(ctx, "vagrant", args...)
+	comm.Dir = dir
+	comm.Stderr = out
+	comm.Stdout = out
+	comm.Cancel = func() error {
+		if err := comm.Process.Signal(os.Interrupt); err != nil {
+			return comm.Process.Kill()
 		}
+		return nil
+	}
+	comm.WaitDelay = vagrantKillDelay
+	if err := comm.Start(); err != nil {
+		log.Printf("[VC] ERROR: While starting command %+v\nERROR: %s\n", comm, err.Error())
+		return err
+	}
+	if err := comm.Wait(); err != nil {
+		log.Printf("[VC] ERROR: While running command %+v\nERROR: %s\n", comm, err.Error())
+		return err
 	}
-	return false
+	return nil
 }
 
+// getBox returns the name of the box matching the label expression
 func (vc *VagrantConnector) getBox(label string) (string, error) {
-	boxes := vc.Config.Boxes
-	for _, box := range boxes {
-		for _, boxLabel := range box.Labels {
-			if boxLabel == label {
-				return box.Name, nil
-			}
-		}
+	box, err := vc.Config.Get().matchBox(label)
+	if err != nil {
+		return "", err
 	}
-	return "", fmt.Errorf("No box for the label %s configured.", label)
+	return box.Name, nil
 }
 
-func (vc *VagrantConnector) SpinUpNew(label string, workingPath string) error {
+func (vc *VagrantConnector) SpinUpNew(label string, workingPath string, register RegisterFunc, out io.Writer) (*Instance, error) {
 	log.Printf("[VC] Trying to start a vagrant machine for the label %s\n", label)
-	box, err := vc.getBox(label)
+	box, err := vc.Config.Get().matchBox(label)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	boxPath := workingPath + "/" + box
+	// Every instance gets its own vagrant environment, so several machines of the same box can run side by side.
+	// The instance is recorded before its directory is created, so the reconciler never takes it for a leftover.
+	// An id that is taken already is generated again, the record it belongs to is kept.
+	var id, boxPath string
+	var inst *Instance
+	for err = ErrInstanceExists; err == ErrInstanceExists; {
+		if id, err = newRandomID(); err != nil {
+			log.Printf("[VagrantConnector]: ERROR: Can't generate an instance id for label %s. Error message: %s", label, err.Error())
+			return nil, err
+		}
+		boxPath = filepath.Join(workingPath, box.Name+"-"+id)
+		inst = &Instance{ID: id, Box: box.Name, Label: label, Dir: boxPath, NodeName: filepath.Base(boxPath), CreatedAt: time.Now()}
+		err = vc.Store.Put(inst, InstanceCreating)
+	}
+	if err != nil {
+		return nil, err
+	}
 	if err := os.MkdirAll(boxPath, 0755); err != nil {
 		log.Printf("[VagrantConnector]: ERROR: Can't create the working directory for label %s on path %s. Error message: %s", label, workingPath, err.Error())
-		return err
+		vc.Store.SetState(id, InstanceFailed)
+		return nil, err
 	}
-	if !vagrantfileExists(boxPath) {
-		initCmd := exec.Command("vagrant", "init", "--force", box)
-		initCmd.Dir = boxPath
-		var errOut bytes.Buffer
-		var out bytes.Buffer
-		initCmd.Stderr = &errOut
-		initCmd.Stdout = &out
-
-		fmt.Printf("[VagrantConnector]: Initializing vagrant enviroment at %s with box %s \n", boxPath, box)
-		if err := initCmd.Start(); err != nil {
-			log.Printf("[VagrantConnector]: ERROR: Can't start command %+v\n", initCmd)
-			return err
-		}
-		log.Printf("[VagrantConnector]: Command %+v stated, waiting to finish...\n", initCmd)
-		if err := initCmd.Wait(); err != nil {
-			log.Printf("[VC]: ERROR: Can't spin up box %s at %s\n", box, boxPath)
-			log.Printf("\nERROR: %s\nOUTPUT: %s\n", errOut.String(), out.String())
-			return err
-		}
+
+	agent, err := register(inst)
+	if err != nil {
+		vc.discard(inst, out)
+		return nil, err
 	}
 
-	fmt.Printf("[VagrantConnector]: Waiting for spin up to complete, this may take a while\n")
-	spinUpExec(box, boxPath)
+	if err := vc.spinUpInstance(box, inst, agent, out); err != nil {
+		vc.discard(inst, out)
+		return nil, err
+	}
+	if box.mode() == BoxModeSnapshot {
+		log.Printf("[VagrantConnector]: Taking the clean snapshot of %s\n", boxPath)
+		if err := vagrantExec(vc.commandContext(), boxPath, out, "snapshot", "save", cleanSnapshot); err != nil {
+			vc.discard(inst, out)
+			return nil, err
+		}
+	}
+	if err := vc.Store.SetState(id, InstanceRunning); err != nil {
+		return nil, err
+	}
 
-	return nil
+	return vc.Store.Get(id)
 }
 
-func (vc *VagrantConnector) GetBoxMemory(label string) (int64, error) {
-	for _, box := range vc.Config.Boxes {
-		for _, l := range box.Labels {
-			if l == label {
-				return units.RAMInBytes(box.Memory)
-			}
+// discard destroys the machine of an instance whose start failed and removes its directory. A half booted machine
+// occupies the host, so the record stays active until the machine is destroyed. If that fails, the record is left
+// destroying for the reconciler.
+func (vc *VagrantConnector) discard(inst *Instance, out io.Writer) {
+	if err := vc.Store.SetState(inst.ID, InstanceDestroying); err != nil {
+		log.Printf("[VagrantConnector]: ERROR: Can't record the destruction of %s. Error: %s\n", inst.Dir, err.Error())
+		return
+	}
+	// Without a Vagrantfile vagrant never created a machine
+	if _, err := os.Stat(filepath.Join(inst.Dir, "Vagrantfile")); err == nil {
+		if err := destroyBox(vc.commandContext(), inst.Dir, out); err != nil {
+			log.Printf("[VagrantConnector]: ERROR: Can't destroy the machine of the failed start at %s. Error: %s\n", inst.Dir, err.Error())
+			return
 		}
 	}
-	return -1, ErrBoxNotFound
+	if err := os.RemoveAll(inst.Dir); err != nil {
+		log.Printf("[VagrantConnector]: Couldn't remove the enviroment directory %s. Error: %s\n", inst.Dir, err.Error())
+	}
+	vc.Store.SetState(inst.ID, InstanceFailed)
 }
 
-func (vc *VagrantConnector) DestroyVms(label string, workingDir string) error {
-	box, err := vc.getBox(label)
+// spinUpInstance renders the Vagrantfile of the instance and boots its machine
+func (vc *VagrantConnector) spinUpInstance(box *confBox, inst *Instance, agent *Agent, out io.Writer) error {
+	boxPath := inst.Dir
+	// Templates may write the agent secret into the Vagrantfile, so only the manager may read it
+	file, err := os.OpenFile(filepath.Join(boxPath, "Vagrantfile"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		log.Printf("[VagrantConnector]: Cannot destroy a machine for label %s. No box found for that label. Error: %s\n", label, err.Error())
+		log.Printf("[VagrantConnector]: ERROR: Can't create the Vagrantfile at %s. Error: %s\n", boxPath, err.Error())
 		return err
 	}
-
-	vi, err := loadVagrantIndex()
+	fmt.Printf("[VagrantConnector]: Initializing vagrant enviroment at %s with box %s \n", boxPath, box.Name)
+	err = renderVagrantfile(file, box, inst, agent)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
-		log.Printf("[VagrantConnector]: Error while loading the vagrant index. Error: %s\n", err.Error())
+		log.Printf("[VagrantConnector]: ERROR: Can't render the Vagrantfile for box %s at %s. Error: %s\n", box.Name, boxPath, err.Error())
 		return err
 	}
 
-	for _, m := range vi.Machines {
-		if m.Name == box && m.State == "running" {
-			return destroyBox(box, workingDir+box)
-		}
+	fmt.Printf("[VagrantConnector]: Waiting for spin up to complete, this may take a while\n")
+	start := time.Now()
+	err = spinUpExec(vc.commandContext(), box.Name, boxPath, out)
+	vagrantUpDuration.WithLabelValues(box.Name).Observe(time.Since(start).Seconds())
+	return err
+}
+
+func (vc *VagrantConnector) GetBoxMemory(label string) (int64, error) {
+	box, err := vc.Config.Get().matchBox(label)
+	if err != nil {
+		return -1, err
 	}
+	return units.RAMInBytes(box.Memory)
+}
 
-	return nil
+// ResetInstance restores the clean snapshot the machine of the instance was saved to after its first provisioning
+func (vc *VagrantConnector) ResetInstance(id string, out io.Writer) (*Instance, error) {
+	inst, err := vc.Store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if inst.State != InstanceRunning {
+		return nil, ErrInstanceNotRunning
+	}
+	if box, ok := vc.Config.Get().box(inst.Box); !ok || box.mode() != BoxModeSnapshot {
+		return nil, ErrNoSnapshot
+	}
+
+	if err := vc.Store.SetState(id, InstanceResetting); err != nil {
+		return nil, err
+	}
+	// The agent is started by the provisioning, so the snapshot must not be provisioned again
+	err = vagrantExec(vc.commandContext(), inst.Dir, out, "snapshot", "restore", "--no-provision", cleanSnapshot)
+	if serr := vc.Store.SetState(id, InstanceRunning); err == nil {
+		err = serr
+	}
+	if err != nil {
+		log.Printf("[VagrantConnector]: Couldn't restore the clean snapshot of %s. Error: %s\n", inst.Dir, err.Error())
+		return nil, err
+	}
+	return vc.Store.Get(id)
 }
 
-func destroyBox(name string, workingDir string) error {
-	cmd := exec.Command("vagrant", "destroy")
+// RecordBuilds adds the builds to the record of the instance, the records of destroyed instances are kept
+// so the machine a build ran on can be looked up afterwards
+func (vc *VagrantConnector) RecordBuilds(id string, urls []string) error {
+	return vc.Store.Update(id, func(inst *Instance) {
+		inst.Builds = append(inst.Builds, urls...)
+	})
+}
 
-	boxPath := workingDir + name
-	cmd.Dir = boxPath
+// DestroyVms destroys every instance of the box configured for label
+func (vc *VagrantConnector) DestroyVms(label string, workingDir string, out io.Writer) ([]*Instance, error) {
+	box, err := vc.getBox(label)
+	if err != nil {
+		log.Printf("[VagrantConnector]: Cannot destroy a machine for label %s. No box found for that label. Error: %s\n", label, err.Error())
+		return nil, err
+	}
 
-	var errOut bytes.Buffer
-	var stdOut bytes.Buffer
-	cmd.Stderr = &errOut
-	cmd.Stdout = &stdOut
+	var destroyed []*Instance
+	for _, inst := range vc.ListVms() {
+		if inst.Box != box {
+			continue
+		}
+		if _, err := vc.DestroyInstance(inst.ID, out); err != nil {
+			return destroyed, err
+		}
+		destroyed = append(destroyed, inst)
+	}
 
-	if err := cmd.Start(); err != nil {
-		log.Printf("[VagrantConnector]: Error while staring the vagrant destory command in path %s. Error: %s\n", boxPath, err.Error())
-		return err
+	return destroyed, nil
+}
+
+// DestroyInstance destroys the vagrant machine of the instance and removes its environment directory
+func (vc *VagrantConnector) DestroyInstance(id string, out io.Writer) (*Instance, error) {
+	inst, err := vc.Store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if !inst.State.active() {
+		return nil, ErrInstanceNotFound
+	}
+
+	previous := inst.State
+	if err := vc.Store.SetState(id, InstanceDestroying); err != nil {
+		return nil, err
+	}
+	if err := destroyBox(vc.commandContext(), inst.Dir, out); err != nil {
+		// The machine is most likely still there
+		vc.Store.SetState(id, previous)
+		return nil, err
+	}
+	if err := vc.Store.SetState(id, InstanceDestroyed); err != nil {
+		return nil, err
 	}
 
-	if err := cmd.Wait(); err != nil {
-		log.Printf("[VagrantConnector]: Error while running the vagrant destroy command in path %s. Error: %s\n", boxPath, err.Error())
+	if err := os.RemoveAll(inst.Dir); err != nil {
+		log.Printf("[VagrantConnector]: Couldn't remove the enviroment directory %s. Error: %s\n", inst.Dir, err.Error())
 	}
+	return inst, nil
+}
 
-	return nil
+func destroyBox(ctx context.Context, boxPath string, out io.Writer) error {
+	return vagrantExec(ctx, boxPath, out, "destroy", "--force")
 }
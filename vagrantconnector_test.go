@@ -2,7 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
 )
 
@@ -26,6 +30,26 @@ func TestGetBox(t *testing.T) {
 	}
 }
 
+func TestGetBoxExpression(t *testing.T) {
+	conf, _ := mockConfig()
+	conf.Boxes = append(conf.Boxes, confBox{Name: "win10-slave", Labels: []string{"windows", "windows10"}, Memory: "4096MB"})
+	vacon := mockVagrantConnector(conf)
+
+	tests := map[string]string{
+		"windows":               "win7-slave",
+		"windows && windows10":  "win10-slave",
+		"windows && !windows10": "win7-slave",
+	}
+	for expr, expected := range tests {
+		if box, err := vacon.getBox(expr); err != nil || box != expected {
+			t.Errorf("Fail: expected %s for %q, got %s, %v", expected, expr, box, err)
+		}
+	}
+	if _, err := vacon.getBox("linux"); err != ErrBoxNotFound {
+		t.Errorf("Fail: expected %s, got %v", ErrBoxNotFound, err)
+	}
+}
+
 func mockConfig() (*Configuration, error) {
 	var c Configuration
 	var configJson = []byte(`{
@@ -56,5 +80,79 @@ func mockVagrantConnector(conf *Configuration) *VagrantConnector {
 	vagrantBoxes = make([]Box, 1, 1)
 	vagrantBoxes[0] = Box{123456, "Test-Box", "Test-Provider", 1.0}
 
-	return &VagrantConnector{vagrantIndex, &vagrantBoxes, conf}
+	return &VagrantConnector{Index: vagrantIndex, Boxes: &vagrantBoxes, Config: NewConfigHolder(conf), Store: NewMemoryStore()}
+}
+
+// fakeVagrant puts a vagrant script on the PATH that logs its arguments to the returned file and fails for the
+// given command
+func fakeVagrant(t *testing.T, failing string) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("The fake vagrant is a shell script")
+	}
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\necho \"$@\" >> " + calls + "\n[ \"$1\" != \"" + failing + "\" ]\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "vagrant"), []byte(script), 0755); err != nil {
+		t.Fatalf("Fail: %s", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return calls
+}
+
+func TestSpinUpNewFailure(t *testing.T) {
+	calls := fakeVagrant(t, "up")
+	conf, _ := mockConfig()
+	vacon := mockVagrantConnector(conf)
+	register := func(inst *Instance) (*Agent, error) { return &Agent{}, nil }
+
+	if _, err := vacon.SpinUpNew("windows", t.TempDir(), register, ioutil.Discard); err == nil {
+		t.Fatalf("Fail: expected the failed vagrant up to be reported")
+	}
+	insts := vacon.Store.List()
+	if len(insts) != 1 || insts[0].State != InstanceFailed {
+		t.Fatalf("Fail: expected one failed instance, got %+v", insts)
+	}
+	if _, err := os.Stat(insts[0].Dir); !os.IsNotExist(err) {
+		t.Errorf("Fail: expected the directory %s to be removed, got %v", insts[0].Dir, err)
+	}
+	if got, _ := ioutil.ReadFile(calls); string(got) != "up\ndestroy --force\n" {
+		t.Errorf("Fail: expected the half booted machine to be destroyed, got %q", got)
+	}
+}
+
+func TestSpinUpNewSnapshotFailure(t *testing.T) {
+	calls := fakeVagrant(t, "snapshot")
+	conf, _ := mockConfig()
+	conf.Boxes[0].Mode = BoxModeSnapshot
+	vacon := mockVagrantConnector(conf)
+	register := func(inst *Instance) (*Agent, error) { return &Agent{}, nil }
+
+	if _, err := vacon.SpinUpNew("windows", t.TempDir(), register, ioutil.Discard); err == nil {
+		t.Fatalf("Fail: expected the failed snapshot to be reported")
+	}
+	if insts := vacon.Store.List(); len(insts) != 1 || insts[0].State != InstanceFailed {
+		t.Errorf("Fail: expected one failed instance, got %+v", insts)
+	}
+	if got, _ := ioutil.ReadFile(calls); string(got) != "up\nsnapshot save jam-clean\ndestroy --force\n" {
+		t.Errorf("Fail: expected the machine without snapshot to be destroyed, got %q", got)
+	}
+}
+
+func TestSpinUpNewVagrantfileMode(t *testing.T) {
+	fakeVagrant(t, "")
+	conf, _ := mockConfig()
+	vacon := mockVagrantConnector(conf)
+	register := func(inst *Instance) (*Agent, error) { return &Agent{Secret: "s3cr3t"}, nil }
+
+	inst, err := vacon.SpinUpNew("windows", t.TempDir(), register, ioutil.Discard)
+	if err != nil {
+		t.Fatalf("Fail: %s", err)
+	}
+	fi, err := os.Stat(filepath.Join(inst.Dir, "Vagrantfile"))
+	if err != nil {
+		t.Fatalf("Fail: %s", err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("Fail: expected the Vagrantfile to be readable by the owner only, got %v", perm)
+	}
 }
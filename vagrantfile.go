@@ -0,0 +1,127 @@
+/*
+ *
+ * Copyright [2014] [Jörn Domnik]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"text/template"
+
+	"github.com/docker/docker/pkg/units"
+)
+
+// defaultVagrantfile is the template used for boxes that don't configure their own vagrantfile_template
+const defaultVagrantfile = `# Generated by jenkins-agent-manager for instance {{.InstanceID}}, do not edit.
+Vagrant.configure("2") do |config|
+  config.vm.box = {{ruby .Box}}
+
+  # The Jenkins agent reads its connection details from jenkins-agent.env in /vagrant
+  config.vm.synced_folder ".", "/vagrant"
+
+  config.vm.provider "virtualbox" do |vb|
+    vb.name = {{ruby .Name}}
+{{- if .Memory}}
+    vb.memory = {{.Memory}}
+{{- end}}
+    vb.cpus = {{.CPUs}}
+  end
+
+  config.vm.provider "libvirt" do |lv|
+{{- if .Memory}}
+    lv.memory = {{.Memory}}
+{{- end}}
+    lv.cpus = {{.CPUs}}
+  end
+end
+`
+
+// vagrantfileData is handed to the Vagrantfile templates
+type vagrantfileData struct {
+	// Box is the name of the vagrant box
+	Box string
+	// InstanceID is the id of the instance, Name the name of its vagrant environment and Jenkins node
+	InstanceID string
+	Name       string
+	// Memory is the memory of the box in megabytes, zero if none is configured
+	Memory int64
+	CPUs   int
+	// JenkinsURL, AgentSecret and AgentWorkDir are the connection details of the Jenkins agent
+	JenkinsURL   string
+	AgentSecret  string
+	AgentWorkDir string
+}
+
+// newVagrantfileData collects the template data for the instance of box
+func newVagrantfileData(box *confBox, inst *Instance, agent *Agent) (*vagrantfileData, error) {
+	data := &vagrantfileData{
+		Box:        box.Name,
+		InstanceID: inst.ID,
+		Name:       inst.NodeName,
+		CPUs:       box.cpus(),
+	}
+	if box.Memory != "" {
+		mem, err := units.RAMInBytes(box.Memory)
+		if err != nil {
+			return nil, err
+		}
+		data.Memory = mem / (1024 * 1024)
+	}
+	if agent != nil {
+		data.JenkinsURL = agent.JenkinsURL
+		data.AgentSecret = agent.Secret
+		data.AgentWorkDir = agent.WorkDir
+	}
+	return data, nil
+}
+
+// vagrantfileFuncs are the functions available in Vagrantfile templates
+var vagrantfileFuncs = template.FuncMap{
+	"ruby": rubyString,
+}
+
+// rubyString quotes s as a ruby string literal, without interpolation
+func rubyString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// loadVagrantfileTemplate parses the template of the box, or the default template if the box has none
+func loadVagrantfileTemplate(box *confBox) (*template.Template, error) {
+	text := defaultVagrantfile
+	if box.VagrantfileTemplate != "" {
+		file, err := ioutil.ReadFile(box.VagrantfileTemplate)
+		if err != nil {
+			return nil, err
+		}
+		text = string(file)
+	}
+	return template.New("Vagrantfile").Funcs(vagrantfileFuncs).Option("missingkey=error").Parse(text)
+}
+
+// renderVagrantfile writes the Vagrantfile for the instance of box to w
+func renderVagrantfile(w io.Writer, box *confBox, inst *Instance, agent *Agent) error {
+	tmpl, err := loadVagrantfileTemplate(box)
+	if err != nil {
+		return err
+	}
+	data, err := newVagrantfileData(box, inst, agent)
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(w, data)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderDefaultVagrantfile(t *testing.T) {
+	box := &confBox{Name: "win7-slave", Memory: "2048MB", CPUs: 2}
+	inst := &Instance{ID: "1a2b3c4d", NodeName: "win7-slave-1a2b3c4d"}
+
+	var out bytes.Buffer
+	if err := renderVagrantfile(&out, box, inst, nil); err != nil {
+		t.Fatalf("Fail: %s", err)
+	}
+	for _, expected := range []string{"config.vm.box = 'win7-slave'", "vb.memory = 2048", "vb.cpus = 2", "instance 1a2b3c4d"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Fail: expected the Vagrantfile to contain %q, got\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestRenderBoxVagrantfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "Vagrantfile.tmpl")
+	ioutil.WriteFile(path, []byte(`ENV["JENKINS_SECRET"] = {{ruby .AgentSecret}} # {{.JenkinsURL}}`), 0644)
+	box := &confBox{Name: "centos7-slave", VagrantfileTemplate: path}
+	agent := &Agent{JenkinsURL: "http://jenkins:8080", Secret: "it's-#{secret}"}
+
+	var out bytes.Buffer
+	if err := renderVagrantfile(&out, box, &Instance{}, agent); err != nil {
+		t.Fatalf("Fail: %s", err)
+	}
+	if expected := `ENV["JENKINS_SECRET"] = 'it\'s-#{secret}' # http://jenkins:8080`; out.String() != expected {
+		t.Errorf("Fail: expected %s, got %s", expected, out.String())
+	}
+}
@@ -0,0 +1,271 @@
+/*
+ *
+ * Copyright [2014] [Jörn Domnik]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/pkg/units"
+)
+
+// ConfigError is a problem with a single setting of the configuration
+type ConfigError struct {
+	// Path is the JSON path of the setting, like boxes[1].memory
+	Path    string
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// ValidationError holds every problem found in a configuration
+type ValidationError []ConfigError
+
+func (e ValidationError) Error() string {
+	lines := make([]string, 0, len(e)+1)
+	lines = append(lines, fmt.Sprintf("The configuration has %d problem(s):", len(e)))
+	for _, ce := range e {
+		lines = append(lines, "  "+ce.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// validator collects the problems of a configuration
+type validator struct {
+	errs ValidationError
+}
+
+func (v *validator) add(path string, format string, args ...interface{}) {
+	v.errs = append(v.errs, ConfigError{path, fmt.Sprintf(format, args...)})
+}
+
+// err returns the collected problems, nil if there are none
+func (v *validator) err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+// Validate checks every setting of the configuration and returns a ValidationError listing all problems
+func (c *Configuration) Validate() error {
+	var v validator
+
+	if c.JenkinsApiUrl == "" {
+		v.add("jenkins_api_url", "is required")
+	} else if u, err := url.Parse(c.JenkinsApiUrl); err != nil {
+		v.add("jenkins_api_url", "is not a valid URL: %s", err.Error())
+	} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.add("jenkins_api_url", "%q is not an absolute http or https URL", c.JenkinsApiUrl)
+	}
+	// The API token is sent as password of the user
+	if c.JenkinsApiSecret != "" && c.JenkinsApiUser == "" {
+		v.add("jenkins_api_user", "is required to authenticate with jenkins_api_secret")
+	}
+
+	if c.ListenerPort != "" {
+		if port, err := strconv.Atoi(c.ListenerPort); err != nil || port < 1 || port > 65535 {
+			v.add("listener_port", "%q is not a port number", c.ListenerPort)
+		}
+	}
+	if c.ListenerAddress != "" && net.ParseIP(c.ListenerAddress) == nil && strings.ContainsAny(c.ListenerAddress, ":/ ") {
+		v.add("listener_address", "%q is not a host name or IP address", c.ListenerAddress)
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		v.add("tls_key_file", "tls_cert_file and tls_key_file have to be set together")
+	}
+	if c.TLSClientCAFile != "" && c.TLSCertFile == "" {
+		v.add("tls_client_ca_file", "%s", ErrNoTLSCert.Error())
+	}
+	v.tokens(c.APITokens)
+
+	if c.MaxVms <= 0 {
+		v.add("max_vm_count", "has to be greater than 0, got %d", c.MaxVms)
+	}
+	if c.WorkingDirPath == "" {
+		v.add("working_dir_path", "is required")
+	}
+	if c.JobWorkers < 0 {
+		v.add("job_workers", "must not be negative, got %d", c.JobWorkers)
+	}
+
+	durations := []struct{ path, value string }{
+		{"autoscale_interval", c.AutoscaleInterval},
+		{"idle_timeout", c.IdleTimeout},
+		{"reconcile_interval", c.ReconcileInterval},
+		{"pool_interval", c.PoolInterval},
+		{"build_watch_interval", c.BuildWatchInterval},
+		{"jenkins_timeout", c.JenkinsTimeout},
+		{"shutdown_timeout", c.ShutdownTimeout},
+		{"config_watch_interval", c.ConfigWatchInterval},
+	}
+	for _, d := range durations {
+		if parsed, err := duration(d.value); err != nil || parsed < 0 {
+			v.add(d.path, "%q is not a duration like 30s or 10m", d.value)
+		}
+	}
+
+	switch c.HostResourceSource {
+	case "", HostResourcesJenkins, HostResourcesMeminfo, HostResourcesCgroup:
+	default:
+		v.add("host_resource_source", "%q is none of %s, %s and %s", c.HostResourceSource,
+			HostResourcesJenkins, HostResourcesMeminfo, HostResourcesCgroup)
+	}
+	if c.CPUOvercommitRatio < 0 {
+		v.add("cpu_overcommit_ratio", "must not be negative, got %g", c.CPUOvercommitRatio)
+	}
+	if c.MaxDiskUsageRatio < 0 || c.MaxDiskUsageRatio > 1 {
+		v.add("max_disk_usage_ratio", "has to be between 0 and 1, got %g", c.MaxDiskUsageRatio)
+	}
+
+	v.boxes(c)
+	return v.err()
+}
+
+// tokens checks the API tokens
+func (v *validator) tokens(tokens []confToken) {
+	names := make(map[string]bool)
+	for i, t := range tokens {
+		path := fmt.Sprintf("api_tokens[%d]", i)
+		if t.Name == "" {
+			v.add(path+".name", "is required")
+		} else if names[t.Name] {
+			v.add(path+".name", "the name %q is used by another token", t.Name)
+		}
+		names[t.Name] = true
+		if t.Token == "" {
+			v.add(path+".token", "is required")
+		}
+		if _, ok := roleLevels[t.Role]; !ok {
+			v.add(path+".role", "%q is none of %s, %s and %s", t.Role, RoleReadOnly, RoleOperator, RoleAdmin)
+		}
+	}
+}
+
+// Warnings returns the settings that are valid but likely not meant as configured. A label several boxes share
+// only selects the first of them, the later boxes are only started for expressions their other labels satisfy.
+// A snapshot box that is always kept online may run a second build before it's reset.
+func (c *Configuration) Warnings() []ConfigError {
+	var warnings []ConfigError
+	owners := make(map[string]string)
+	for i, box := range c.Boxes {
+		if box.mode() == BoxModeSnapshot && box.retentionStrategy() == defaultRetentionStrategy {
+			warnings = append(warnings, ConfigError{fmt.Sprintf("boxes[%d].retention_strategy", i),
+				fmt.Sprintf("with %s the agent may run a second build before it's reset", defaultRetentionStrategy)})
+		}
+		for j, l := range box.Labels {
+			owner, shared := owners[l]
+			if !shared {
+				owners[l] = box.Name
+				continue
+			}
+			if owner != box.Name {
+				warnings = append(warnings, ConfigError{fmt.Sprintf("boxes[%d].labels[%d]", i, j),
+					fmt.Sprintf("the label %q is shared with the earlier box %q, which is started for it", l, owner)})
+			}
+		}
+	}
+	return warnings
+}
+
+// boxes checks the boxes and that every box can be selected by a label expression
+func (v *validator) boxes(c *Configuration) {
+	if len(c.Boxes) == 0 {
+		v.add("boxes", "at least one box is required")
+	}
+
+	names := make(map[string]bool)
+	minReady := 0
+	for i := range c.Boxes {
+		box := &c.Boxes[i]
+		path := fmt.Sprintf("boxes[%d]", i)
+
+		if box.Name == "" {
+			v.add(path+".name", "is required")
+		} else if names[box.Name] {
+			v.add(path+".name", "the box %q is configured twice", box.Name)
+		}
+		names[box.Name] = true
+
+		if len(box.Labels) == 0 {
+			v.add(path+".labels", "at least one label is required")
+		}
+		labels := make(map[string]bool)
+		for j, l := range box.Labels {
+			switch {
+			case l == "" || strings.ContainsAny(l, " \t\n"):
+				v.add(fmt.Sprintf("%s.labels[%d]", path, j), "%q is not a label, labels must not be empty or contain whitespace", l)
+			case labels[l]:
+				v.add(fmt.Sprintf("%s.labels[%d]", path, j), "the label %q is listed twice", l)
+			}
+			labels[l] = true
+		}
+		// A box whose labels are all labels of an earlier box is never started, the earlier box always wins
+		if box.Name != "" && len(box.Labels) > 0 {
+			if _, err := c.boxSelector(box.Name); err != nil {
+				v.add(path+".labels", "%s", err.Error())
+			}
+		}
+
+		if box.Memory == "" {
+			v.add(path+".memory", "is required")
+		} else if mem, err := units.RAMInBytes(box.Memory); err != nil || mem <= 0 {
+			v.add(path+".memory", "%q is not a size like 2048MB or 2GB", box.Memory)
+		}
+		if box.Disk != "" {
+			if disk, err := units.RAMInBytes(box.Disk); err != nil || disk <= 0 {
+				v.add(path+".disk", "%q is not a size like 40GB", box.Disk)
+			}
+		}
+		if box.CPUs < 0 {
+			v.add(path+".cpus", "must not be negative, got %d", box.CPUs)
+		}
+		if box.Executors < 0 {
+			v.add(path+".executors", "must not be negative, got %d", box.Executors)
+		}
+		if box.MinReady < 0 {
+			v.add(path+".min_ready", "must not be negative, got %d", box.MinReady)
+		}
+		minReady += box.MinReady
+
+		switch box.Mode {
+		case "", BoxModePersistent, BoxModeSnapshot:
+		case BoxModeEphemeral:
+			// An agent that is always kept online may take a second build before the build watcher saw the first
+			if box.retentionStrategy() == defaultRetentionStrategy {
+				v.add(path+".retention_strategy", "ephemeral boxes need a one-shot retention strategy, %s accepts more than one build", defaultRetentionStrategy)
+			}
+		default:
+			v.add(path+".mode", "%q is none of %s, %s and %s", box.Mode, BoxModePersistent, BoxModeSnapshot, BoxModeEphemeral)
+		}
+		if box.VagrantfileTemplate != "" {
+			if _, err := loadVagrantfileTemplate(box); err != nil {
+				v.add(path+".vagrantfile_template", "%s", err.Error())
+			}
+		}
+	}
+
+	if c.MaxVms > 0 && minReady > c.MaxVms {
+		v.add("boxes", "the boxes keep %d agents ready, but max_vm_count allows only %d", minReady, c.MaxVms)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	conf, _ := mockConfig()
+	if err := conf.Validate(); err != nil {
+		t.Errorf("Fail: expected the mock configuration to be valid, got %s", err)
+	}
+
+	conf.JenkinsApiUrl = "localhost:8080"
+	conf.MaxVms = 0
+	conf.IdleTimeout = "15 minutes"
+	conf.Boxes = append(conf.Boxes,
+		confBox{Name: "", Labels: []string{"linux"}, Memory: "2048MB"},
+		confBox{Name: "win7-copy", Labels: []string{"windows"}, Memory: "lots", Mode: "disposable"},
+	)
+	err := conf.Validate()
+	ve, ok := err.(ValidationError)
+	if !ok {
+		t.Fatalf("Fail: expected a ValidationError, got %v", err)
+	}
+
+	var paths []string
+	for _, ce := range ve {
+		paths = append(paths, ce.Path)
+	}
+	sort.Strings(paths)
+	expected := []string{"boxes[1].name", "boxes[2].labels", "boxes[2].memory", "boxes[2].mode", "idle_timeout",
+		"jenkins_api_url", "max_vm_count"}
+	if strings.Join(paths, " ") != strings.Join(expected, " ") {
+		t.Errorf("Fail: expected problems with %v, got %v", expected, paths)
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	conf, _ := mockConfig()
+	if warnings := conf.Warnings(); len(warnings) != 0 {
+		t.Errorf("Fail: expected no warnings for the mock configuration, got %v", warnings)
+	}
+
+	conf.Boxes = append(conf.Boxes, confBox{Name: "win10", Labels: []string{"win10", "windows"}, Memory: "4GB"})
+	if err := conf.Validate(); err != nil {
+		t.Errorf("Fail: expected boxes sharing a label to be valid, got %s", err)
+	}
+	warnings := conf.Warnings()
+	if len(warnings) != 1 || warnings[0].Path != "boxes[1].labels[1]" || !strings.Contains(warnings[0].Message, `"windows"`) {
+		t.Errorf("Fail: expected a warning for the shared label windows, got %v", warnings)
+	}
+
+	conf.Boxes[0].Mode = BoxModeSnapshot
+	if warnings := conf.Warnings(); len(warnings) != 2 || warnings[0].Path != "boxes[0].retention_strategy" {
+		t.Errorf("Fail: expected a warning for the retention strategy of the snapshot box, got %v", warnings)
+	}
+	conf.Boxes[0].RetentionStrategy = "org.example.OnceRetentionStrategy"
+	if warnings := conf.Warnings(); len(warnings) != 1 {
+		t.Errorf("Fail: expected no warning for a one-shot retention strategy, got %v", warnings)
+	}
+}
+
+func TestValidateEphemeral(t *testing.T) {
+	conf, _ := mockConfig()
+	conf.Boxes[0].Mode = BoxModeEphemeral
+	ve, ok := conf.Validate().(ValidationError)
+	if !ok || len(ve) != 1 || ve[0].Path != "boxes[0].retention_strategy" {
+		t.Errorf("Fail: expected an ephemeral box without retention strategy to be refused, got %v", ve)
+	}
+	conf.Boxes[0].RetentionStrategy = "org.example.OnceRetentionStrategy"
+	if err := conf.Validate(); err != nil {
+		t.Errorf("Fail: expected an ephemeral box with a one-shot retention strategy to be valid, got %s", err)
+	}
+}
+
+func TestNewConfigurationInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeTestFile(t, path, `{"jenkins_api_url":"http://localhost:8080","max_vm_count":0}`)
+
+	if c, err := NewConfiguration(path); c != nil || err == nil {
+		t.Errorf("Fail: expected no configuration with an error, got %+v, %v", c, err)
+	}
+}
+
+func TestNewConfigurationTypeError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeTestFile(t, path, `{"jenkins_api_url":"http://localhost:8080","max_vm_count":"2"}`)
+
+	_, err := NewConfiguration(path)
+	if ve, ok := err.(ValidationError); !ok || len(ve) != 1 || ve[0].Path != "max_vm_count" {
+		t.Errorf("Fail: expected a problem with max_vm_count, got %v", err)
+	}
+}
+
+func TestNewConfigurationFormats(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"config.yaml": `
+jenkins_api_url: http://localhost:8080
+max_vm_count: 2
+working_dir_path: /tmp
+boxes:
+  # Comments are allowed in YAML
+  - name: linux
+    labels: [linux]
+    memory: 1GB
+    min_ready: 1
+`,
+		"config.toml": `
+jenkins_api_url = "http://localhost:8080"
+max_vm_count = 2
+working_dir_path = "/tmp"
+
+[[boxes]]
+name = "linux"
+labels = ["linux"]
+memory = "1GB"
+min_ready = 1
+`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		writeTestFile(t, path, content)
+		c, err := NewConfiguration(path)
+		if err != nil {
+			t.Errorf("Fail: expected %s to be valid, got %s", name, err)
+			continue
+		}
+		if c.MaxVms != 2 || len(c.Boxes) != 1 || c.Boxes[0].Labels[0] != "linux" || c.Boxes[0].MinReady != 1 {
+			t.Errorf("Fail: unexpected configuration from %s: %+v", name, c)
+		}
+	}
+
+	// Settings of the wrong type are reported with their path in every format
+	typeErrors := map[string]string{
+		"types.json": `{"jenkins_api_url":"http://localhost:8080","boxes":[{"name":"linux","cpus":1},{"name":"win","cpus":"two"}]}`,
+		"types.yaml": "jenkins_api_url: http://localhost:8080\nboxes:\n  - name: linux\n    cpus: 1\n  - name: win\n    cpus: two\n",
+		"types.toml": "jenkins_api_url = \"http://localhost:8080\"\n\n[[boxes]]\nname = \"linux\"\ncpus = 1\n\n[[boxes]]\nname = \"win\"\ncpus = \"two\"\n",
+	}
+	for name, content := range typeErrors {
+		path := filepath.Join(dir, name)
+		writeTestFile(t, path, content)
+		_, err := NewConfiguration(path)
+		// Older versions of Go leave the index of the box out
+		if ve, ok := err.(ValidationError); !ok || len(ve) != 1 || (ve[0].Path != "boxes[1].cpus" && ve[0].Path != "boxes.cpus") {
+			t.Errorf("Fail: expected a problem with boxes[1].cpus in %s, got %v", name, err)
+		}
+	}
+	path := filepath.Join(dir, "maxvms.toml")
+	writeTestFile(t, path, "max_vm_count = \"2\"\n")
+	if _, err := NewConfiguration(path); !strings.Contains(fmt.Sprint(err), "max_vm_count: expected a int, got a string") {
+		t.Errorf("Fail: expected a problem with max_vm_count, got %v", err)
+	}
+
+	path = filepath.Join(dir, "invalid.yml")
+	writeTestFile(t, path, "jenkins_api_url: localhost\nmax_vm_count: 0\nworking_dir_path: /tmp\n")
+	_, err := NewConfiguration(path)
+	if ve, ok := err.(ValidationError); !ok || len(ve) != 3 {
+		t.Errorf("Fail: expected the YAML configuration to be validated like JSON, got %v", err)
+	}
+}